@@ -256,6 +256,11 @@ func GetFileInfo(filename string, br *float64, spf, sr, frames, ch *int) error {
 
 	defer f.Close()
 
+	// m4a and other MP4 containers
+	if IsMP4(f) {
+		return getMP4FileInfo(f, br, spf, sr, frames, ch)
+	}
+
 	firstFramePos := SeekTo1StFrame(*f)
 	if firstFramePos == -1 {
 		err := new(util.FileError)
@@ -0,0 +1,509 @@
+package aac
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/util"
+)
+
+// audio track of MP4/M4A (ISO-BMFF) file
+type mp4Track struct {
+	timescale     uint32
+	duration      uint64
+	aot           int // audio object type of the AAC core
+	sfindex       int // sampling frequency index of the AAC core
+	ch            int
+	sampleSizes   []uint32
+	sampleOffsets []int64
+}
+
+// MP4Reader reads AAC samples from MP4 file and returns them as ADTS frames
+type MP4Reader struct {
+	f     *os.File
+	track *mp4Track
+	next  int
+}
+
+// walks the boxes between start and end
+func readBoxes(f io.ReaderAt, start, end int64, fn func(typ string, data, size int64) error) error {
+	header := make([]byte, 16)
+	for pos := start; pos+8 <= end; {
+		if _, err := f.ReadAt(header[:8], pos); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		typ := string(header[4:8])
+		hdr := int64(8)
+		switch size {
+		case 0:
+			// box extends to the end of the file
+			size = end - pos
+		case 1:
+			// 64 bit largesize
+			if _, err := f.ReadAt(header[8:16], pos+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			hdr = 16
+		}
+		if size < hdr || pos+size > end {
+			return errors.New("Bad MP4 box: " + typ)
+		}
+		if err := fn(typ, pos+hdr, size-hdr); err != nil {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
+
+func readBox(f io.ReaderAt, data, size int64) ([]byte, error) {
+	if size > 64*1024*1024 {
+		return nil, errors.New("MP4 box too large")
+	}
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, data); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// reads MPEG-4 descriptor header, returns tag, payload size and header length
+func readDescriptor(b []byte) (byte, int, int) {
+	if len(b) < 2 {
+		return 0, 0, 0
+	}
+	size := 0
+	n := 1
+	for i := 0; i < 4 && n < len(b); i++ {
+		size = size<<7 | int(b[n]&0x7F)
+		n++
+		if b[n-1]&0x80 == 0 {
+			break
+		}
+	}
+	return b[0], size, n
+}
+
+// finds AudioSpecificConfig in esds box
+func parseESDS(b []byte) ([]byte, error) {
+	// skip full box header
+	if len(b) < 4 {
+		return nil, errors.New("Bad esds box")
+	}
+	b = b[4:]
+
+	tag, size, n := readDescriptor(b)
+	if tag != 0x03 {
+		return nil, errors.New("No ES descriptor in esds box")
+	}
+	es := b[n:]
+	if size < len(es) {
+		es = es[:size]
+	}
+	if len(es) < 3 {
+		return nil, errors.New("Bad ES descriptor")
+	}
+	flags := es[2]
+	pos := 3
+	if flags&0x80 != 0 {
+		pos += 2
+	}
+	if flags&0x40 != 0 && pos < len(es) {
+		pos += int(es[pos]) + 1
+	}
+	if flags&0x20 != 0 {
+		pos += 2
+	}
+	if pos >= len(es) {
+		return nil, errors.New("Bad ES descriptor")
+	}
+
+	tag, size, n = readDescriptor(es[pos:])
+	if tag != 0x04 {
+		return nil, errors.New("No decoder config in esds box")
+	}
+	dc := es[pos+n:]
+	if size < len(dc) {
+		dc = dc[:size]
+	}
+	if len(dc) < 13 {
+		return nil, errors.New("Bad decoder config in esds box")
+	}
+	if dc[0] != 0x40 && dc[0] != 0x66 && dc[0] != 0x67 && dc[0] != 0x68 {
+		return nil, errors.New("Not an AAC track, object type 0x" + strconv.FormatInt(int64(dc[0]), 16))
+	}
+
+	tag, size, n = readDescriptor(dc[13:])
+	if tag != 0x05 || 13+n+size > len(dc) {
+		return nil, errors.New("No AudioSpecificConfig in esds box")
+	}
+	return dc[13+n : 13+n+size], nil
+}
+
+// bit reader for AudioSpecificConfig
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) read(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := 0
+		if r.pos/8 < len(r.b) {
+			bit = int(r.b[r.pos/8]>>(7-uint(r.pos%8))) & 1
+		}
+		v = v<<1 | bit
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) objectType() int {
+	aot := r.read(5)
+	if aot == 31 {
+		aot = 32 + r.read(6)
+	}
+	return aot
+}
+
+func (r *bitReader) sfIndex() int {
+	idx := r.read(4)
+	if idx == 15 {
+		// explicit frequency, map it to the table
+		freq := r.read(24)
+		for i, sf := range sftable {
+			if sf == freq {
+				return i
+			}
+		}
+	}
+	return idx
+}
+
+// parses AudioSpecificConfig, returns the AAC core object type,
+// sampling frequency index and channel configuration
+func parseASC(asc []byte) (aot, sfindex, ch int, err error) {
+	r := &bitReader{b: asc}
+	aot = r.objectType()
+	sfindex = r.sfIndex()
+	ch = r.read(4)
+	if aot == 5 || aot == 29 {
+		// explicit SBR/PS signaling, the core follows
+		r.sfIndex()
+		aot = r.objectType()
+	}
+	if aot < 1 || aot > 4 {
+		return 0, 0, 0, errors.New("Unsupported AAC object type " + strconv.Itoa(aot))
+	}
+	if sfindex > 12 || sftable[sfindex] == 0 {
+		return 0, 0, 0, errors.New("Unsupported AAC sampling frequency")
+	}
+	if ch < 1 || ch > 7 {
+		return 0, 0, 0, errors.New("Unsupported AAC channel configuration " + strconv.Itoa(ch))
+	}
+	return aot, sfindex, ch, nil
+}
+
+// parses a trak box, returns nil if it is not an AAC audio track.
+// fsize is the file size, the samples have to be within the file.
+func parseTrak(f io.ReaderAt, fsize, data, size int64) (*mp4Track, error) {
+	t := &mp4Track{}
+	var isAudio bool
+	var asc []byte
+	var stsc [][3]uint32
+	var chunkOffsets []int64
+	var sampleSize, sampleCount uint32
+
+	var walk func(typ string, data, size int64) error
+	walk = func(typ string, data, size int64) error {
+		switch typ {
+		case "mdia", "minf", "stbl":
+			return readBoxes(f, data, data+size, walk)
+		case "hdlr":
+			b, err := readBox(f, data, size)
+			if err != nil || len(b) < 12 {
+				return err
+			}
+			isAudio = string(b[8:12]) == "soun"
+		case "mdhd":
+			b, err := readBox(f, data, size)
+			if err != nil || len(b) < 24 {
+				return err
+			}
+			if b[0] == 1 && len(b) >= 32 {
+				t.timescale = binary.BigEndian.Uint32(b[20:])
+				t.duration = binary.BigEndian.Uint64(b[24:])
+			} else {
+				t.timescale = binary.BigEndian.Uint32(b[12:])
+				t.duration = uint64(binary.BigEndian.Uint32(b[16:]))
+			}
+		case "stsd":
+			b, err := readBox(f, data, size)
+			if err != nil || len(b) < 16 {
+				return err
+			}
+			// first sample entry only
+			entry := b[8:]
+			if string(entry[4:8]) != "mp4a" || len(entry) < 36 {
+				return nil
+			}
+			// sound sample description, quicktime versions 1 and 2 are longer
+			children := 36
+			switch binary.BigEndian.Uint16(entry[16:]) {
+			case 1:
+				children += 16
+			case 2:
+				children += 36
+			}
+			entrySize := int(binary.BigEndian.Uint32(entry[0:4]))
+			if entrySize > len(entry) {
+				entrySize = len(entry)
+			}
+			if children >= entrySize {
+				return nil
+			}
+			return readBoxes(f, data+8+int64(children), data+8+int64(entrySize), walk)
+		case "esds":
+			b, err := readBox(f, data, size)
+			if err != nil {
+				return err
+			}
+			asc, err = parseESDS(b)
+			return err
+		case "stsz":
+			b, err := readBox(f, data, size)
+			if err != nil || len(b) < 12 {
+				return err
+			}
+			sampleSize = binary.BigEndian.Uint32(b[4:])
+			sampleCount = binary.BigEndian.Uint32(b[8:])
+			if sampleSize != 0 && int64(sampleCount)*int64(sampleSize) > fsize {
+				return errors.New("Bad stsz box: samples exceed the file")
+			}
+			if sampleSize == 0 {
+				for i := 0; i < int(sampleCount) && 12+i*4+4 <= len(b); i++ {
+					t.sampleSizes = append(t.sampleSizes, binary.BigEndian.Uint32(b[12+i*4:]))
+				}
+			}
+		case "stco", "co64":
+			b, err := readBox(f, data, size)
+			if err != nil || len(b) < 8 {
+				return err
+			}
+			width := 4
+			if typ == "co64" {
+				width = 8
+			}
+			// the count of a malformed box can be far more than it holds
+			n := int(binary.BigEndian.Uint32(b[4:]))
+			if max := (len(b) - 8) / width; n > max {
+				n = max
+			}
+			for i := 0; i < n; i++ {
+				if typ == "stco" {
+					chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint32(b[8+i*4:])))
+				} else {
+					chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint64(b[8+i*8:])))
+				}
+			}
+		case "stsc":
+			b, err := readBox(f, data, size)
+			if err != nil || len(b) < 8 {
+				return err
+			}
+			n := int(binary.BigEndian.Uint32(b[4:]))
+			for i := 0; i < n && 8+i*12+12 <= len(b); i++ {
+				e := b[8+i*12:]
+				// chunks are numbered from 1
+				if binary.BigEndian.Uint32(e) < 1 {
+					return errors.New("Bad stsc box: chunk 0")
+				}
+				stsc = append(stsc, [3]uint32{binary.BigEndian.Uint32(e), binary.BigEndian.Uint32(e[4:]), binary.BigEndian.Uint32(e[8:])})
+			}
+		}
+		return nil
+	}
+
+	if err := readBoxes(f, data, data+size, walk); err != nil {
+		return nil, err
+	}
+	if !isAudio || asc == nil {
+		return nil, nil
+	}
+
+	var err error
+	if t.aot, t.sfindex, t.ch, err = parseASC(asc); err != nil {
+		return nil, err
+	}
+
+	if sampleSize != 0 {
+		t.sampleSizes = make([]uint32, sampleCount)
+		for i := range t.sampleSizes {
+			t.sampleSizes[i] = sampleSize
+		}
+	}
+
+	// sample offsets from sample-to-chunk and chunk offset tables
+	sample := 0
+samples:
+	for i := range stsc {
+		first := int(stsc[i][0])
+		last := len(chunkOffsets)
+		if i+1 < len(stsc) {
+			last = int(stsc[i+1][0]) - 1
+		}
+		for chunk := first; chunk <= last && chunk <= len(chunkOffsets); chunk++ {
+			offset := chunkOffsets[chunk-1]
+			for j := 0; j < int(stsc[i][1]) && sample < len(t.sampleSizes); j++ {
+				if offset < 0 || offset+int64(t.sampleSizes[sample]) > fsize {
+					// the file is cut, the rest of the samples are missing
+					break samples
+				}
+				t.sampleOffsets = append(t.sampleOffsets, offset)
+				offset += int64(t.sampleSizes[sample])
+				sample++
+			}
+		}
+	}
+	t.sampleSizes = t.sampleSizes[:len(t.sampleOffsets)]
+	if len(t.sampleSizes) == 0 {
+		return nil, errors.New("No AAC samples in MP4 track")
+	}
+	return t, nil
+}
+
+// finds the first AAC audio track
+func parseMP4(f *os.File) (*mp4Track, error) {
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var track *mp4Track
+	err = readBoxes(f, 0, finfo.Size(), func(typ string, data, size int64) error {
+		if typ != "moov" {
+			return nil
+		}
+		return readBoxes(f, data, data+size, func(typ string, data, size int64) error {
+			if typ != "trak" || track != nil {
+				return nil
+			}
+			t, err := parseTrak(f, finfo.Size(), data, size)
+			if err != nil {
+				return err
+			}
+			track = t
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if track == nil {
+		return nil, errors.New("No AAC audio track in MP4 file")
+	}
+	return track, nil
+}
+
+// IsMP4 checks if the file is MP4/M4A (ISO-BMFF) container
+func IsMP4(f *os.File) bool {
+	buf := make([]byte, 8)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return false
+	}
+	return string(buf[4:8]) == "ftyp"
+}
+
+func NewMP4Reader(f *os.File) (*MP4Reader, error) {
+	track, err := parseMP4(f)
+	if err != nil {
+		return nil, err
+	}
+	return &MP4Reader{f: f, track: track}, nil
+}
+
+// builds ADTS header for the raw AAC frame of size n
+func (t *mp4Track) adtsHeader(n int) []byte {
+	frameLength := n + 7
+	profile := t.aot - 1
+	return []byte{
+		0xFF,
+		0xF1, // MPEG-4, no CRC
+		byte(profile<<6) | byte(t.sfindex<<2) | byte(t.ch>>2),
+		byte((t.ch&0x03)<<6) | byte(frameLength>>11),
+		byte(frameLength >> 3),
+		byte((frameLength&0x07)<<5) | 0x1F,
+		0xFC,
+	}
+}
+
+// GetFrames reads the next samples and returns them as ADTS frames
+func (m *MP4Reader) GetFrames(framesToRead int) ([]byte, error) {
+	var buf []byte
+	for i := 0; i < framesToRead && m.next < len(m.track.sampleSizes); i++ {
+		size := int(m.track.sampleSizes[m.next])
+		if size+7 > 0x1FFF {
+			return nil, errors.New("AAC frame too large for ADTS at sample " + strconv.Itoa(m.next))
+		}
+		raw := make([]byte, size)
+		if _, err := m.f.ReadAt(raw, m.track.sampleOffsets[m.next]); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = append(buf, m.track.adtsHeader(size)...)
+		buf = append(buf, raw...)
+		m.next++
+	}
+	return buf, nil
+}
+
+// Seek moves to the AAC frame, the next GetFrames starts from it
+func (m *MP4Reader) Seek(frame int) {
+	if frame > len(m.track.sampleSizes) {
+		frame = len(m.track.sampleSizes)
+	}
+	m.next = frame
+}
+
+// gets information about AAC track in MP4 file
+func getMP4FileInfo(f *os.File, br *float64, spf, sr, frames, ch *int) error {
+	track, err := parseMP4(f)
+	if err != nil {
+		ferr := new(util.FileError)
+		ferr.Msg = "Bad MP4 file: " + err.Error()
+		return ferr
+	}
+
+	var bytes int64
+	for _, size := range track.sampleSizes {
+		bytes += int64(size)
+	}
+
+	*spf = 1024
+	*sr = sftable[track.sfindex]
+	*ch = track.ch
+	*frames = len(track.sampleSizes)
+	playtime := float64(*frames) * 1024 / float64(*sr)
+	if track.timescale > 0 && track.duration > 0 {
+		playtime = float64(track.duration) / float64(track.timescale)
+	}
+	if playtime > 0 {
+		*br = float64(bytes) / playtime * 8 / 1000
+	}
+
+	logger.Log("container : MP4", logger.LOG_DEBUG)
+	logger.Log("profile   : "+strconv.Itoa(track.aot), logger.LOG_DEBUG)
+	logger.Log("frames    : "+strconv.Itoa(*frames), logger.LOG_DEBUG)
+	logger.Log("samplerate: "+strconv.Itoa(*sr)+" Hz", logger.LOG_DEBUG)
+	logger.Log("channels  : "+strconv.Itoa(*ch), logger.LOG_DEBUG)
+	logger.Log("playtime  : "+strconv.Itoa(int(playtime))+" sec", logger.LOG_DEBUG)
+	logger.Log("bitrate   : "+strconv.Itoa(int(*br))+" kbps (average)", logger.LOG_DEBUG)
+
+	return nil
+}
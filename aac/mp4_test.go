@@ -0,0 +1,125 @@
+package aac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// builds a box of the payloads
+func box(typ string, payload ...[]byte) []byte {
+	b := make([]byte, 8)
+	b = append(b[:4], typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func u32(v ...uint32) []byte {
+	var b []byte
+	for _, n := range v {
+		b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return b
+}
+
+// AAC LC, 44100 Hz, stereo
+var testASC = []byte{0x12, 0x10}
+
+// builds an esds box payload with the AudioSpecificConfig
+func esds(asc []byte) []byte {
+	dsi := append([]byte{0x05, byte(len(asc))}, asc...)
+	dc := append([]byte{0x04, byte(13 + len(dsi)), 0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, dsi...)
+	es := append([]byte{0x03, byte(3 + len(dc) + 3), 0, 1, 0}, dc...)
+	es = append(es, 0x06, 0x01, 0x02)
+	return append([]byte{0, 0, 0, 0}, es...)
+}
+
+func TestParseESDS(t *testing.T) {
+	asc, err := parseESDS(esds(testASC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(asc, testASC) {
+		t.Errorf("parseESDS() = % x, want % x", asc, testASC)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"full box header only", []byte{0, 0, 0, 0}},
+		{"ES descriptor of 1 byte", []byte{0, 0, 0, 0, 0x03, 0x01, 0x00, 0x01, 0x00}},
+		{"ES descriptor of 2 bytes", []byte{0, 0, 0, 0, 0x03, 0x02, 0x00, 0x01}},
+		{"no decoder config", []byte{0, 0, 0, 0, 0x03, 0x03, 0x00, 0x01, 0x00}},
+		{"decoder config of 5 bytes", []byte{0, 0, 0, 0, 0x03, 0x0A, 0x00, 0x01, 0x00,
+			0x04, 0x05, 0x40, 0x15, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"ES URL past the end", []byte{0, 0, 0, 0, 0x03, 0x04, 0x00, 0x01, 0x40, 0xFF}},
+		{"no AudioSpecificConfig", []byte{0, 0, 0, 0, 0x03, 0x12, 0x00, 0x01, 0x00,
+			0x04, 0x0D, 0x40, 0x15, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		if _, err := parseESDS(tt.b); err == nil {
+			t.Errorf("parseESDS(%s) didn't fail", tt.name)
+		}
+	}
+
+	// every truncation of a valid box fails without panic
+	b := esds(testASC)
+	for n := 0; n < len(b)-3; n++ {
+		if _, err := parseESDS(b[:n]); err == nil {
+			t.Errorf("parseESDS() of %d bytes didn't fail", n)
+		}
+	}
+}
+
+// builds a trak box of an AAC track with the sample tables
+func trak(stsz, stsc, stco []byte) []byte {
+	mp4a := make([]byte, 28)
+	binary.BigEndian.PutUint16(mp4a[6:], 1) // data reference index
+	mp4a = append(mp4a, box("esds", esds(testASC))...)
+	stsd := box("stsd", u32(0, 1), box("mp4a", mp4a))
+	stbl := box("stbl", stsd, box("stsz", stsz), box("stsc", stsc), box("stco", stco))
+	hdlr := box("hdlr", u32(0, 0), []byte("soun"), make([]byte, 13))
+	return box("trak", box("mdia", hdlr, box("minf", stbl)))
+}
+
+func TestParseTrak(t *testing.T) {
+	tests := []struct {
+		name    string
+		stsz    []byte
+		stsc    []byte
+		stco    []byte
+		samples int // -1 if parsing fails
+	}{
+		{"fixed size", u32(0, 100, 4), u32(0, 1, 1, 4, 1), u32(0, 1, 0), 4},
+		{"variable size", u32(0, 0, 3, 10, 20, 30), u32(0, 1, 1, 2, 1), u32(0, 2, 0, 100), 3},
+		{"chunk 0", u32(0, 100, 4), u32(0, 1, 0, 4, 1), u32(0, 1, 0), -1},
+		{"huge sample count", u32(0, 400, 0xFFFFFFFF), u32(0, 1, 1, 0xFFFFFFFF, 1), u32(0, 1, 0), -1},
+		{"samples past the end", u32(0, 0, 3, 100, 100, 1000), u32(0, 1, 1, 3, 1), u32(0, 1, 0), 2},
+		{"stsc entries past the box", u32(0, 100, 4), u32(0, 1000), u32(0, 1, 0), -1},
+		{"huge chunk count", u32(0, 100, 4), u32(0, 1, 1, 4, 1), u32(0, 0xFFFFFFFF, 0), 4},
+	}
+	for _, tt := range tests {
+		b := trak(tt.stsz, tt.stsc, tt.stco)
+		// the samples are at the start of the file
+		fsize := int64(1000)
+		track, err := parseTrak(bytes.NewReader(b), fsize, 8, int64(len(b))-8)
+		if tt.samples < 0 {
+			if err == nil {
+				t.Errorf("parseTrak(%s) didn't fail", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTrak(%s) failed: %v", tt.name, err)
+			continue
+		}
+		if len(track.sampleSizes) != tt.samples || len(track.sampleOffsets) != tt.samples {
+			t.Errorf("parseTrak(%s) has %d samples, want %d", tt.name, len(track.sampleSizes), tt.samples)
+		}
+	}
+}
@@ -1,9 +1,53 @@
 package config
 
 import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/go-ini/ini"
 )
 
+// Server is a single streaming destination
+type Server struct {
+	Name          string
+	ServerType    string `ini:"server"`
+	Protocol      string `ini:"protocol"`
+	Chunked       bool   `ini:"chunked"`
+	Host          string `ini:"host"`
+	Port          int    `ini:"port"`
+	Mount         string `ini:"mount"`
+	User          string `ini:"user"`
+	Password      string `ini:"password"`
+	StreamID      int    `ini:"streamid"`
+	Charset       string `ini:"charset"`
+	TLS           bool   `ini:"tls"`
+	TLSVerify     bool   `ini:"tlsverify"`
+	TLSServerName string `ini:"tlsservername"`
+	TLSCAFile     string `ini:"tlscafile"`
+	TLSCertFile   string `ini:"tlscert"`
+	TLSKeyFile    string `ini:"tlskey"`
+}
+
+// Category is a rotation category, the [category.name] section
+type Category struct {
+	Name     string
+	Playlist string // playlist file or directory
+	Weight   int    // how often it's picked among the alternatives of a clock slot
+	Random   bool
+}
+
+// Show is a scheduled playlist, the [schedule.name] section
+type Show struct {
+	Name         string
+	Days         [7]bool       // on air days, by time.Weekday
+	Start        time.Duration // time of the day
+	End          time.Duration // the next day if it's not after Start
+	Playlist     string
+	PlaylistType string
+}
+
 type Config struct {
 	StreamType        string `ini:"streamtype"`
 	StreamFormat      string `ini:"format"`
@@ -12,21 +56,22 @@ type Config struct {
 	StreamChannels    int    `ini:"channels"`
 	StreamSamplerate  int    `ini:"samplerate"`
 	StreamAACProfile  string `ini:"aacprofile"`
-	ServerType        string `ini:"server"`
-	Host              string `ini:"host"`
-	Port              int    `ini:"port"`
-	Mount             string `ini:"mount"`
+	Servers           []Server
 	ConnAttempts      int    `ini:"connectionattempts"`
-	Password          string `ini:"password"`
 	BufferSize        int    `ini:"buffersize"`
 	Playlist          string `ini:"playlist"`
-	PlaylistType      string `ini:"playlistype"`
+	PlaylistType      string `ini:"playlisttype"`
 	NpFile            string `ini:"npfile"`
+	ResumePosition    bool   `ini:"resumeposition"`
 	LogFile           string `ini:"logfile"`
-	ScriptFile        string `ini:"logfile"`
+	ScriptFile        string `ini:"script"`
 	LogLevel          int    `ini:"loglevel"`
 	PlayRandom        bool   `ini:"playrandom"`
+	ArtistGap         int    `ini:"artistgap"`
 	UpdateMetadata    bool   `ini:"updatemetadata"`
+	MetadataFormat    string `ini:"metadataformat"`
+	MetadataInput     string `ini:"metadatainput"`
+	MetadataInterval  int    `ini:"metadatainterval"`
 	StreamName        string `ini:"name"`
 	StreamDescription string `ini:"description"`
 	StreamURL         string `ini:"url"`
@@ -35,6 +80,20 @@ type Config struct {
 	IsDaemon          bool   `ini:"daemon"`
 	PidFile           string
 	FFMPEGPath        string
+
+	// rotation categories and the clock of every hour
+	Categories []Category
+	Clocks     [24]string
+
+	// scheduled playlists, and whether they cut in the playing track
+	Schedule      []Show
+	ScheduleCutIn bool
+
+	// listener requests, the socket they come from, seconds between
+	// the requests of a requester and the max number of queued ones
+	RequestInput     string
+	RequestInterval  int
+	RequestQueueSize int
 }
 
 const Version = "0.3"
@@ -48,12 +107,13 @@ func LoadConfig(filename string) error {
 		return err
 	}
 
-	Cfg.ServerType = ini.Section("server").Key("server").Value()
-	Cfg.Host = ini.Section("server").Key("host").Value()
-	Cfg.Port, _ = ini.Section("server").Key("port").Int()
-	Cfg.Mount = ini.Section("server").Key("mount").Value()
+	// [server] is the main destination, every [server.name]
+	// section adds a mirror which inherits unset keys from [server]
+	Cfg.Servers = []Server{loadServer(ini.Section("server"))}
+	for _, section := range ini.Section("server").ChildSections() {
+		Cfg.Servers = append(Cfg.Servers, loadServer(section))
+	}
 	Cfg.ConnAttempts, _ = ini.Section("server").Key("connectionattempts").Int()
-	Cfg.Password = ini.Section("server").Key("password").Value()
 
 	Cfg.StreamType = ini.Section("stream").Key("streamtype").Value()
 	Cfg.StreamFormat = ini.Section("stream").Key("format").Value()
@@ -73,12 +133,41 @@ func LoadConfig(filename string) error {
 	Cfg.PlaylistType = ini.Section("playlist").Key("playlisttype").Value()
 	Cfg.Playlist = ini.Section("playlist").Key("playlist").Value()
 	Cfg.PlayRandom, _ = ini.Section("playlist").Key("playrandom").Bool()
+	Cfg.ArtistGap, _ = ini.Section("playlist").Key("artistgap").Int()
+	Cfg.Categories = nil
+	for _, section := range ini.Section("category").ChildSections() {
+		Cfg.Categories = append(Cfg.Categories, Category{
+			Name:     strings.TrimPrefix(section.Name(), "category."),
+			Playlist: section.Key("playlist").Value(),
+			Weight:   section.Key("weight").MustInt(1),
+			Random:   section.Key("random").MustBool(true),
+		})
+	}
+	if err := loadClocks(ini.Section("clock")); err != nil {
+		return err
+	}
+	Cfg.Schedule = nil
+	for _, section := range ini.Section("schedule").ChildSections() {
+		show, err := loadShow(section)
+		if err != nil {
+			return err
+		}
+		Cfg.Schedule = append(Cfg.Schedule, show)
+	}
+	Cfg.ScheduleCutIn, _ = ini.Section("schedule").Key("cutin").Bool()
+	Cfg.RequestInput = ini.Section("requests").Key("input").Value()
+	Cfg.RequestInterval = ini.Section("requests").Key("interval").MustInt(300)
+	Cfg.RequestQueueSize = ini.Section("requests").Key("queuesize").MustInt(20)
 
 	Cfg.BufferSize, _ = ini.Section("misc").Key("buffersize").Int()
 	Cfg.BufferSize *= 1000
 	Cfg.UpdateMetadata, _ = ini.Section("misc").Key("updatemetadata").Bool()
+	Cfg.MetadataFormat = ini.Section("misc").Key("metadataformat").Value()
+	Cfg.MetadataInput = ini.Section("misc").Key("metadatainput").Value()
+	Cfg.MetadataInterval = ini.Section("misc").Key("metadatainterval").MustInt(5)
 	Cfg.ScriptFile = ini.Section("misc").Key("script").Value()
 	Cfg.NpFile = ini.Section("misc").Key("npfile").Value()
+	Cfg.ResumePosition, _ = ini.Section("misc").Key("resumeposition").Bool()
 	Cfg.LogFile = ini.Section("misc").Key("logfile").Value()
 	Cfg.LogLevel, _ = ini.Section("misc").Key("loglevel").Int()
 	Cfg.IsDaemon, _ = ini.Section("misc").Key("daemon").Bool()
@@ -87,6 +176,147 @@ func LoadConfig(filename string) error {
 	return nil
 }
 
+// reads the clock of every hour, "default" is used for the hours
+// without their own clock. Hours are set as "7" or "07", or "6-9"
+// for several hours.
+func loadClocks(section *ini.Section) error {
+	Cfg.Clocks = [24]string{}
+	def := section.Key("default").Value()
+	for h := range Cfg.Clocks {
+		Cfg.Clocks[h] = def
+	}
+	for _, key := range section.Keys() {
+		if key.Name() == "default" {
+			continue
+		}
+		hours := strings.SplitN(key.Name(), "-", 2)
+		from, err := strconv.Atoi(hours[0])
+		to := from
+		if err == nil && len(hours) == 2 {
+			to, err = strconv.Atoi(hours[1])
+		}
+		if err != nil || from < 0 || to > 23 || from > to {
+			return errors.New("Bad clock hour: " + key.Name())
+		}
+		for h := from; h <= to; h++ {
+			Cfg.Clocks[h] = key.Value()
+		}
+	}
+	return nil
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func weekday(name string) (int, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, d := range weekdays {
+		if len(name) >= 3 && strings.HasPrefix(name, d) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("Bad day of week: " + name)
+}
+
+// parses days like "mon-fri", "sat,sun" or "daily"
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "*" || s == "daily" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		r := strings.SplitN(part, "-", 2)
+		from, err := weekday(r[0])
+		if err != nil {
+			return days, err
+		}
+		to := from
+		if len(r) == 2 {
+			if to, err = weekday(r[1]); err != nil {
+				return days, err
+			}
+		}
+		// ranges like fri-mon go over the weekend
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parses time of the day as hh:mm
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hm := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(hm) == 2 {
+		h, herr := strconv.Atoi(hm[0])
+		m, merr := strconv.Atoi(hm[1])
+		if herr == nil && merr == nil && h >= 0 && m >= 0 && m < 60 && (h < 24 || h == 24 && m == 0) {
+			return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+		}
+	}
+	return 0, errors.New("Bad time of day: " + s)
+}
+
+func loadShow(section *ini.Section) (Show, error) {
+	show := Show{Name: strings.TrimPrefix(section.Name(), "schedule.")}
+	var err error
+	if show.Days, err = parseDays(section.Key("days").Value()); err != nil {
+		return show, errors.New("Schedule " + show.Name + ": " + err.Error())
+	}
+	if show.Start, err = parseTimeOfDay(section.Key("start").Value()); err != nil {
+		return show, errors.New("Schedule " + show.Name + ": " + err.Error())
+	}
+	if show.End, err = parseTimeOfDay(section.Key("end").Value()); err != nil {
+		return show, errors.New("Schedule " + show.Name + ": " + err.Error())
+	}
+	show.Playlist = section.Key("playlist").Value()
+	show.PlaylistType = section.Key("playlisttype").Value()
+	if show.Playlist == "" && show.PlaylistType != "rotation" {
+		return show, errors.New("Schedule " + show.Name + ": no playlist")
+	}
+	return show, nil
+}
+
+func loadServer(section *ini.Section) Server {
+	srv := Server{Name: section.Name()}
+	srv.ServerType = section.Key("server").Value()
+	srv.Protocol = section.Key("protocol").In("source", []string{"source", "put"})
+	srv.Chunked, _ = section.Key("chunked").Bool()
+	srv.Host = section.Key("host").Value()
+	srv.Port, _ = section.Key("port").Int()
+	srv.Mount = section.Key("mount").Value()
+	srv.User = section.Key("user").Value()
+	srv.Password = section.Key("password").Value()
+	srv.StreamID = section.Key("streamid").MustInt(1)
+	switch strings.ToLower(section.Key("charset").Value()) {
+	case "utf-8", "utf8":
+		srv.Charset = "UTF-8"
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1":
+		srv.Charset = "ISO-8859-1"
+	default:
+		// shoutcast v1 listeners expect latin1
+		if srv.ServerType == "shoutcast" {
+			srv.Charset = "ISO-8859-1"
+		} else {
+			srv.Charset = "UTF-8"
+		}
+	}
+	if srv.ServerType == "shoutcast2" {
+		// ultravox xml metadata is always utf-8
+		srv.Charset = "UTF-8"
+	}
+	srv.TLS, _ = section.Key("tls").Bool()
+	srv.TLSVerify = section.Key("tlsverify").MustBool(true)
+	srv.TLSServerName = section.Key("tlsservername").Value()
+	srv.TLSCAFile = section.Key("tlscafile").Value()
+	srv.TLSCertFile = section.Key("tlscert").Value()
+	srv.TLSKeyFile = section.Key("tlskey").Value()
+	return srv
+}
+
 func init() {
 	Cfg.LogLevel = 1
 	Cfg.LogFile = "goicy.log"
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeOfDay(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		err  bool
+	}{
+		{"00:00", 0, false},
+		{"6:30", 6*time.Hour + 30*time.Minute, false},
+		{" 23:59 ", 23*time.Hour + 59*time.Minute, false},
+		{"24:00", 24 * time.Hour, false},
+		{"24:59", 0, true},
+		{"25:00", 0, true},
+		{"12:60", 0, true},
+		{"-1:00", 0, true},
+		{"12", 0, true},
+		{"ab:cd", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeOfDay(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseTimeOfDay(%q) = %v, want error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseTimeOfDay(%q) = %v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+}
@@ -2,119 +2,334 @@ package cuesheet
 
 import (
 	"bufio"
-	"github.com/stunndard/goicy/logger"
-	"github.com/stunndard/goicy/metadata"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/metadata"
+	"github.com/stunndard/goicy/util"
 )
 
-type cueEntry struct {
-	Title  string
-	Artist string
-	Time   uint32 // in milliseconds
+// FramesPerSecond is the cuesheet time resolution, positions are mm:ss:ff
+const FramesPerSecond = 75
+
+// Track is a single track of the cuesheet, positions are in frames
+// from the beginning of its file
+type Track struct {
+	Number     int
+	File       string // audio file, relative to the current dir or absolute
+	Title      string
+	Performer  string
+	Songwriter string
+	ISRC       string
+	Pregap     int // INDEX 00, -1 if there is none
+	Start      int // INDEX 01
+	End        int // INDEX 01 of the next track in the file, -1 for the last one
+	Rem        map[string]string
+}
+
+// CueSheet is a parsed .cue file
+type CueSheet struct {
+	Title     string
+	Performer string
+	Genre     string
+	Date      string
+	Catalog   string
+	Rem       map[string]string // all disc level REM fields, keys are upper case
+	Files     []string
+	Tracks    []*Track
 }
 
-var cueEntries []cueEntry
-var idx int
-var loaded bool
+// Duration converts cuesheet frames to time
+func Duration(frames int) time.Duration {
+	return time.Duration(frames) * time.Second / FramesPerSecond
+}
 
-func get_value(entry, key string) string {
-	s := string(entry[len(key)+1:])
-	if string(s[0]) == "\"" {
-		s = s[1 : len(s)-1]
+// StartTime returns the start of the track in its file
+func (t *Track) StartTime() time.Duration {
+	return Duration(t.Start)
+}
+
+// EndTime returns the end of the track in its file, 0 if the
+// track lasts until the end of the file
+func (t *Track) EndTime() time.Duration {
+	if t.End < 0 {
+		return 0
 	}
-	//fmt.Println(key, "=", s)
-	return s
+	return Duration(t.End)
 }
 
-func get_time(time string) uint32 {
-	ttime := time[0 : len(time)-3] //Copy(time, 1, length(time) - 3);
+// PerformerOrDisc returns the track performer, or the disc one if it's not set
+func (c *CueSheet) PerformerOrDisc(t *Track) string {
+	if t.Performer != "" {
+		return t.Performer
+	}
+	return c.Performer
+}
 
-	s := ttime[0 : len(ttime)-3]
-	z, _ := strconv.Atoi(s)
-	s = ttime[len(ttime)-2:]
-	x, _ := strconv.Atoi(s)
-	//fmt.Println(z)
-	//fmt.Println(x)
-	return uint32(z*60000 + x*1000)
+// Fields returns the metadata fields of the track, the empty ones are not set
+func (c *CueSheet) Fields(t *Track) map[string]string {
+	fields := make(map[string]string)
+	for k, v := range map[string]string{
+		"artist":   c.PerformerOrDisc(t),
+		"title":    t.Title,
+		"album":    c.Title,
+		"genre":    c.Genre,
+		"year":     c.Date,
+		"composer": t.Songwriter,
+		"track":    strconv.Itoa(t.Number),
+	} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return fields
 }
 
-func isUpdate(time uint32) bool {
-	res := false
-	//fmt.Println("isupdate: ", time)
-	if idx < len(cueEntries) {
-		if time >= cueEntries[idx].Time {
-			idx = idx + 1
-			res = true
+// parses mm:ss:ff into frames
+func parseTime(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, errors.New("Bad cuesheet time: " + s)
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return 0, errors.New("Bad cuesheet time: " + s)
 		}
+		v[i] = n
 	}
-	return res
+	if v[1] >= 60 || v[2] >= FramesPerSecond {
+		return 0, errors.New("Bad cuesheet time: " + s)
+	}
+	return (v[0]*60+v[1])*FramesPerSecond + v[2], nil
 }
 
-func get_tags() (artist, title string) {
-	if idx > 0 {
-		artist = cueEntries[idx-1].Artist
-		title = cueEntries[idx-1].Title
+// splits the line into words, quoted strings are single words
+func fields(line string) []string {
+	var words []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				words = append(words, line[1:])
+				break
+			}
+			words = append(words, line[1:end+1])
+			line = line[end+2:]
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			words = append(words, line)
+			break
+		}
+		words = append(words, line[:end])
+		line = line[end:]
 	}
-	return artist, title
+	return words
 }
 
-func Update(time uint32) {
-	if !loaded {
-		return
+// Parse reads a cuesheet, relative FILE names are resolved against dir
+func Parse(r io.Reader, dir string) (*CueSheet, error) {
+	c := &CueSheet{Rem: make(map[string]string)}
+	var track *Track
+	file := ""
+
+	// malformed lines are skipped
+	warn := func(msg string, line int) {
+		logger.Log("Cuesheet: "+msg+" at line "+strconv.Itoa(line), logger.LOG_DEBUG)
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		// cuesheets are often not in UTF-8, take them as Latin-1 then
+		line := metadata.ToUTF8(scanner.Text())
+		if n == 1 {
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
+		words := fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		arg := func(i int) string {
+			if i < len(words) {
+				return words[i]
+			}
+			return ""
+		}
+
+		switch strings.ToUpper(words[0]) {
+		case "REM":
+			key := strings.ToUpper(arg(1))
+			value := ""
+			if len(words) > 2 {
+				value = strings.Join(words[2:], " ")
+			}
+			if key == "" {
+				continue
+			}
+			if track != nil {
+				track.Rem[key] = value
+				continue
+			}
+			c.Rem[key] = value
+			switch key {
+			case "GENRE":
+				c.Genre = value
+			case "DATE":
+				c.Date = value
+			}
+		case "CATALOG":
+			c.Catalog = arg(1)
+		case "FILE":
+			file = arg(1)
+			if file != "" && !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			c.Files = append(c.Files, file)
+		case "TRACK":
+			num, err := strconv.Atoi(arg(1))
+			if err != nil {
+				warn("Bad TRACK number", n)
+				num = len(c.Tracks) + 1
+			}
+			if file == "" {
+				warn("TRACK without FILE", n)
+			}
+			track = &Track{Number: num, File: file, Pregap: -1, Start: -1, End: -1, Rem: make(map[string]string)}
+			c.Tracks = append(c.Tracks, track)
+		case "TITLE":
+			if track != nil {
+				track.Title = arg(1)
+			} else {
+				c.Title = arg(1)
+			}
+		case "PERFORMER":
+			if track != nil {
+				track.Performer = arg(1)
+			} else {
+				c.Performer = arg(1)
+			}
+		case "SONGWRITER":
+			if track != nil {
+				track.Songwriter = arg(1)
+			}
+		case "ISRC":
+			if track != nil {
+				track.ISRC = arg(1)
+			}
+		case "INDEX":
+			if track == nil {
+				continue
+			}
+			idx, err := strconv.Atoi(arg(1))
+			if err != nil {
+				warn("Bad INDEX", n)
+				continue
+			}
+			pos, err := parseTime(arg(2))
+			if err != nil {
+				warn(err.Error(), n)
+				continue
+			}
+			if track.File != file {
+				// the index points into the next file, the pregap
+				// of the track is at the end of the previous one
+				track.File = file
+				track.Pregap = -1
+			}
+			switch idx {
+			case 0:
+				track.Pregap = pos
+			case 1:
+				track.Start = pos
+			}
+		}
 	}
-	if isUpdate(time) {
-		md := metadata.FormatMetadata(get_tags())
-		go metadata.SendMetadata(md)
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-}
 
-func Load(cuefile string) bool {
-	var entry string
+	// drop the tracks without INDEX 01 or FILE
+	tracks := c.Tracks[:0]
+	for _, t := range c.Tracks {
+		if t.Start >= 0 && t.File != "" {
+			tracks = append(tracks, t)
+		}
+	}
+	c.Tracks = tracks
+	if len(c.Tracks) == 0 {
+		return nil, errors.New("No tracks in cuesheet")
+	}
 
-	loaded = false
-	idx = 0
-	cueEntries = nil
+	// a track ends where the next one in the same file starts
+	for i, t := range c.Tracks[:len(c.Tracks)-1] {
+		if next := c.Tracks[i+1]; next.File == t.File && next.Start > t.Start {
+			t.End = next.Start
+		}
+	}
+	return c, nil
+}
 
+// ParseFile reads the cuesheet file
+func ParseFile(cuefile string) (*CueSheet, error) {
 	f, err := os.Open(cuefile)
 	if err != nil {
-		//fmt.Println("error opening file ", err)
-		return false
+		return nil, err
 	}
 	defer f.Close()
-	r := bufio.NewReader(f)
-	for err != io.EOF {
-		entry, err = r.ReadString(0x0A) // 0x0A separator = newline
-		entry = strings.Trim(entry, "\r\n ")
-		for (err != io.EOF) && (entry[0:5] == "TRACK") {
-			cueEntries = append(cueEntries, cueEntry{})
-			entry, err = r.ReadString(0x0A)
-			entry = strings.Trim(entry, "\r\n ")
-			for (err != io.EOF) && (entry[0:5] != "TRACK") {
-				if entry[0:5] == "TITLE" {
-					cueEntries[idx].Title = get_value(entry, "TITLE")
-				}
-				if entry[0:9] == "PERFORMER" {
-					cueEntries[idx].Artist = get_value(entry, "PERFORMER")
-				}
-				if entry[0:8] == "INDEX 01" {
-					cueEntries[idx].Time = get_time(get_value(entry, "INDEX 01"))
-				}
-				if (err != nil) && (err == io.EOF) {
-					break
-				}
-				entry, err = r.ReadString(0x0A)
-				entry = strings.Trim(entry, "\r\n ")
-			}
-			idx = idx + 1
+	return Parse(f, filepath.Dir(cuefile))
+}
+
+// Load loads the cuesheet, returns nil if there is none or it can't be parsed
+func Load(cuefile string) *CueSheet {
+	if !util.FileExists(cuefile) {
+		return nil
+	}
+	c, err := ParseFile(cuefile)
+	if err != nil {
+		logger.Log("Cannot load cuesheet "+cuefile+": "+err.Error(), logger.LOG_ERROR)
+		return nil
+	}
+	logger.Log("Loaded cuesheet: "+cuefile, logger.LOG_INFO)
+	return c
+}
+
+// FileTracks returns the tracks in the audio file. If the cuesheet has
+// a single FILE all its tracks are returned, as the audio is often
+// converted to another format after the cuesheet was made.
+func (c *CueSheet) FileTracks(filename string) []*Track {
+	if c == nil {
+		return nil
+	}
+	if len(c.Files) == 1 {
+		return c.Tracks
+	}
+	name := strings.ToLower(util.Basename(filepath.Base(filename)))
+	var tracks []*Track
+	for _, t := range c.Tracks {
+		if strings.ToLower(util.Basename(filepath.Base(t.File))) == name {
+			tracks = append(tracks, t)
 		}
 	}
-	loaded = idx > 0
-	idx = 0
-	if loaded {
-		logger.Log("Loaded cuesheet: "+cuefile, logger.LOG_INFO)
+	return tracks
+}
+
+// TrackAt returns the track playing at the position of the audio file,
+// nil if there is none
+func (c *CueSheet) TrackAt(filename string, pos time.Duration) *Track {
+	var res *Track
+	for _, t := range c.FileTracks(filename) {
+		if t.StartTime() <= pos {
+			res = t
+		}
 	}
-	return loaded
+	return res
 }
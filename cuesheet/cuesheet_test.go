@@ -0,0 +1,243 @@
+package cuesheet
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+		err  bool
+	}{
+		{"00:00:00", 0, false},
+		{"01:02:03", (60+2)*75 + 3, false},
+		{"99:59:74", (99*60+59)*75 + 74, false},
+		{"00:60:00", 0, true},
+		{"00:00:75", 0, true},
+		{"00:-1:00", 0, true},
+		{"00:00", 0, true},
+		{"00:00:00:00", 0, true},
+		{"aa:bb:cc", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseTime(%q) = %d, want error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseTime(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+type wantTrack struct {
+	file       string
+	title      string
+	performer  string
+	start, end int
+	pregap     int
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		sheet  string
+		title  string
+		tracks []wantTrack
+		err    bool
+	}{
+		{
+			name: "single file",
+			sheet: `REM GENRE Rock
+REM DATE 1999
+PERFORMER "Disc Artist"
+TITLE "Album"
+FILE "album.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "One"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Two"
+    PERFORMER "Guest"
+    INDEX 00 02:59:00
+    INDEX 01 03:00:00
+`,
+			title: "Album",
+			tracks: []wantTrack{
+				{"album.flac", "One", "", 0, 180 * 75, -1},
+				{"album.flac", "Two", "Guest", 180 * 75, -1, 179 * 75},
+			},
+		},
+		{
+			name: "multiple files",
+			sheet: `FILE "01.wav" WAVE
+  TRACK 01 AUDIO
+    TITLE "One"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Two"
+    INDEX 00 04:00:00
+FILE "02.wav" WAVE
+    INDEX 01 00:00:00
+  TRACK 03 AUDIO
+    TITLE "Three"
+    INDEX 01 03:00:00
+`,
+			tracks: []wantTrack{
+				{"01.wav", "One", "", 0, -1, -1},
+				{"02.wav", "Two", "", 0, 180 * 75, -1},
+				{"02.wav", "Three", "", 180 * 75, -1, -1},
+			},
+		},
+		{
+			name: "missing INDEX 01",
+			sheet: `FILE "a.mp3" MP3
+  TRACK 01 AUDIO
+    TITLE "One"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "No index"
+  TRACK 03 AUDIO
+    TITLE "Three"
+    INDEX 01 05:00:00
+`,
+			tracks: []wantTrack{
+				{"a.mp3", "One", "", 0, 300 * 75, -1},
+				{"a.mp3", "Three", "", 300 * 75, -1, -1},
+			},
+		},
+		{
+			name: "bad times",
+			sheet: `FILE "a.mp3" MP3
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    INDEX 01 01:60:00
+  TRACK 03 AUDIO
+    INDEX 01 02:00:75
+  TRACK 04 AUDIO
+    INDEX 01 3:00
+  TRACK 05 AUDIO
+    INDEX 01 04:00:00
+`,
+			tracks: []wantTrack{
+				{"a.mp3", "", "", 0, 240 * 75, -1},
+				{"a.mp3", "", "", 240 * 75, -1, -1},
+			},
+		},
+		{
+			name:  "BOM and CRLF",
+			sheet: "\uFEFFTITLE \"Album\"\r\nFILE \"a.mp3\" MP3\r\n  TRACK 01 AUDIO\r\n    TITLE \"Ünïcode\"\r\n    INDEX 01 00:00:00\r\n",
+			title: "Album",
+			tracks: []wantTrack{
+				{"a.mp3", "Ünïcode", "", 0, -1, -1},
+			},
+		},
+		{
+			name:  "Latin-1",
+			sheet: "PERFORMER \"Bj\xf6rk\"\nFILE \"a.mp3\" MP3\n  TRACK 01 AUDIO\n    TITLE \"Caf\xe9\"\n    INDEX 01 00:00:00\n",
+			tracks: []wantTrack{
+				{"a.mp3", "Café", "", 0, -1, -1},
+			},
+		},
+		{
+			name: "no tracks",
+			sheet: `FILE "a.mp3" MP3
+  TRACK 01 AUDIO
+    TITLE "No index"
+`,
+			err: true,
+		},
+		{
+			name: "track without file",
+			sheet: `TRACK 01 AUDIO
+  INDEX 01 00:00:00
+`,
+			err: true,
+		},
+	}
+
+	dir := filepath.FromSlash("/music")
+	for _, tt := range tests {
+		c, err := Parse(strings.NewReader(tt.sheet), dir)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Parse(%s) didn't fail", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", tt.name, err)
+			continue
+		}
+		if c.Title != tt.title {
+			t.Errorf("Parse(%s) title = %q, want %q", tt.name, c.Title, tt.title)
+		}
+		if len(c.Tracks) != len(tt.tracks) {
+			t.Errorf("Parse(%s) has %d tracks, want %d", tt.name, len(c.Tracks), len(tt.tracks))
+			continue
+		}
+		for i, w := range tt.tracks {
+			tr := c.Tracks[i]
+			if tr.File != filepath.Join(dir, w.file) || tr.Title != w.title || tr.Performer != w.performer ||
+				tr.Start != w.start || tr.End != w.end || tr.Pregap != w.pregap {
+				t.Errorf("Parse(%s) track %d = %+v, want %+v", tt.name, i, *tr, w)
+			}
+		}
+	}
+}
+
+func TestLatin1Performer(t *testing.T) {
+	c, err := Parse(strings.NewReader("PERFORMER \"Bj\xf6rk\"\nFILE a.mp3 MP3\nTRACK 01 AUDIO\nINDEX 01 00:00:00\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Fields(c.Tracks[0])["artist"]; got != "Björk" {
+		t.Errorf("artist = %q, want %q", got, "Björk")
+	}
+}
+
+func TestTrackAt(t *testing.T) {
+	sheet := `FILE "01.flac" WAVE
+  TRACK 01 AUDIO
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    INDEX 01 03:00:00
+FILE "02.flac" WAVE
+  TRACK 03 AUDIO
+    INDEX 01 00:00:00
+`
+	c, err := Parse(strings.NewReader(sheet), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file string
+		pos  time.Duration
+		want int // track number, 0 for none
+	}{
+		{"01.flac", 0, 1},
+		{"01.flac", 179 * time.Second, 1},
+		{"01.flac", 180 * time.Second, 2},
+		{"01.mp3", 200 * time.Second, 2},
+		{"02.flac", time.Second, 3},
+		{"03.flac", time.Second, 0},
+	}
+	for _, tt := range tests {
+		got := 0
+		if tr := c.TrackAt(tt.file, tt.pos); tr != nil {
+			got = tr.Number
+		}
+		if got != tt.want {
+			t.Errorf("TrackAt(%s, %v) = track %d, want %d", tt.file, tt.pos, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package flac
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/ogg"
+	"github.com/stunndard/goicy/util"
+)
+
+// metadata block types
+const (
+	blockStreamInfo    = 0
+	blockVorbisComment = 4
+)
+
+var srtable = [...]int{
+	0, 88200, 176400, 192000,
+	8000, 16000, 22050, 24000,
+	32000, 44100, 48000, 96000,
+	0, 0, 0, 0}
+
+// StreamInfo is the FLAC STREAMINFO metadata block
+type StreamInfo struct {
+	MinBlockSize  int
+	MaxBlockSize  int
+	MinFrameSize  int
+	MaxFrameSize  int
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	TotalSamples  int64
+	Raw           []byte // the block as is, without the block header
+}
+
+var crc8table [256]byte
+var crc16table [256]uint16
+
+func init() {
+	for i := range crc8table {
+		c := byte(i)
+		for j := 0; j < 8; j++ {
+			if c&0x80 != 0 {
+				c = (c << 1) ^ 0x07
+			} else {
+				c <<= 1
+			}
+		}
+		crc8table[i] = c
+	}
+	for i := range crc16table {
+		c := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if c&0x8000 != 0 {
+				c = (c << 1) ^ 0x8005
+			} else {
+				c <<= 1
+			}
+		}
+		crc16table[i] = c
+	}
+}
+
+func crc8(b []byte) byte {
+	var c byte
+	for _, v := range b {
+		c = crc8table[c^v]
+	}
+	return c
+}
+
+func crc16(b []byte) uint16 {
+	var c uint16
+	for _, v := range b {
+		c = (c << 8) ^ crc16table[byte(c>>8)^v]
+	}
+	return c
+}
+
+func parseStreamInfo(b []byte) *StreamInfo {
+	si := &StreamInfo{
+		MinBlockSize:  int(binary.BigEndian.Uint16(b[0:])),
+		MaxBlockSize:  int(binary.BigEndian.Uint16(b[2:])),
+		MinFrameSize:  int(b[4])<<16 | int(b[5])<<8 | int(b[6]),
+		MaxFrameSize:  int(b[7])<<16 | int(b[8])<<8 | int(b[9]),
+		SampleRate:    int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4,
+		Channels:      int((b[12]>>1)&0x07) + 1,
+		BitsPerSample: int((b[12]&0x01)<<4|b[13]>>4) + 1,
+		TotalSamples:  int64(b[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(b[14:])),
+		Raw:           append([]byte(nil), b[:34]...),
+	}
+	return si
+}
+
+// ReadHeader skips ID3v2 tags and reads FLAC metadata blocks,
+// leaving the reader at the first audio frame
+func ReadHeader(r *bufio.Reader) (*StreamInfo, error) {
+	for {
+		b, err := r.Peek(10)
+		if err != nil {
+			return nil, err
+		}
+		if string(b[0:3]) != "ID3" {
+			break
+		}
+		r.Discard(int(b[6])<<21 | int(b[7])<<14 | int(b[8])<<7 | int(b[9]) + 10)
+	}
+
+	marker := make([]byte, 4)
+	if _, err := io.ReadFull(r, marker); err != nil {
+		return nil, err
+	}
+	if string(marker) != "fLaC" {
+		return nil, errors.New("Not a FLAC file")
+	}
+
+	var si *StreamInfo
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		block := make([]byte, int(header[1])<<16|int(header[2])<<8|int(header[3]))
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+		if blockType == blockStreamInfo && len(block) >= 34 {
+			si = parseStreamInfo(block)
+		}
+		if last {
+			break
+		}
+	}
+	if si == nil || si.SampleRate == 0 {
+		return nil, errors.New("No valid STREAMINFO block")
+	}
+	return si, nil
+}
+
+// checks the frame header and returns its length and block size
+func parseFrameHeader(h []byte, si *StreamInfo) (int, int, bool) {
+	if len(h) < 6 || h[0] != 0xFF || h[1]&0xFE != 0xF8 {
+		return 0, 0, false
+	}
+	bscode := h[2] >> 4
+	srcode := h[2] & 0x0F
+	chcode := h[3] >> 4
+	sscode := (h[3] >> 1) & 0x07
+	if bscode == 0 || srcode == 15 || chcode > 10 || sscode == 3 || h[3]&0x01 != 0 {
+		return 0, 0, false
+	}
+
+	// utf-8 like coded frame or sample number
+	n := 1
+	switch {
+	case h[4]&0x80 == 0:
+		n = 1
+	case h[4]&0xE0 == 0xC0:
+		n = 2
+	case h[4]&0xF0 == 0xE0:
+		n = 3
+	case h[4]&0xF8 == 0xF0:
+		n = 4
+	case h[4]&0xFC == 0xF8:
+		n = 5
+	case h[4]&0xFE == 0xFC:
+		n = 6
+	case h[4] == 0xFE:
+		n = 7
+	default:
+		return 0, 0, false
+	}
+	pos := 4 + n
+
+	blocksize := 0
+	switch {
+	case bscode == 1:
+		blocksize = 192
+	case bscode <= 5:
+		blocksize = 576 << (bscode - 2)
+	case bscode == 6:
+		if len(h) < pos+1 {
+			return 0, 0, false
+		}
+		blocksize = int(h[pos]) + 1
+		pos++
+	case bscode == 7:
+		if len(h) < pos+2 {
+			return 0, 0, false
+		}
+		blocksize = int(binary.BigEndian.Uint16(h[pos:])) + 1
+		pos += 2
+	default:
+		blocksize = 256 << (bscode - 8)
+	}
+
+	switch srcode {
+	case 12:
+		pos++
+	case 13, 14:
+		pos += 2
+	default:
+		if srcode != 0 && si != nil && srtable[srcode] != si.SampleRate {
+			return 0, 0, false
+		}
+	}
+
+	if len(h) < pos+1 || crc8(h[:pos]) != h[pos] {
+		return 0, 0, false
+	}
+	return pos + 1, blocksize, true
+}
+
+// ReadFrame reads a whole frame and returns it with its block size.
+// FLAC frames have no length, so the frame ends where the next valid
+// frame header begins and the CRC-16 of the collected data matches.
+func ReadFrame(r *bufio.Reader, si *StreamInfo) ([]byte, int, error) {
+	// sync to the frame header
+	inSync := true
+	for {
+		h, err := r.Peek(16)
+		if len(h) < 6 {
+			if err == nil {
+				err = io.EOF
+			}
+			return nil, 0, err
+		}
+		if _, _, ok := parseFrameHeader(h, si); ok {
+			break
+		}
+		if inSync {
+			logger.Log("Bad FLAC frame, resyncing...", logger.LOG_DEBUG)
+			inSync = false
+		}
+		r.Discard(1)
+	}
+
+	h, _ := r.Peek(16)
+	hlen, blocksize, _ := parseFrameHeader(h, si)
+	data := make([]byte, hlen, si.MaxFrameSize+hlen)
+	io.ReadFull(r, data)
+
+	// running CRC-16 over the frame including its own CRC
+	// becomes zero exactly at the end of the frame
+	c := crc16(data)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			// the input file has ended, that was the last frame
+			return data, blocksize, nil
+		}
+		data = append(data, b)
+		c = (c << 8) ^ crc16table[byte(c>>8)^b]
+
+		if c != 0 || len(data) < hlen+2 {
+			continue
+		}
+		next, _ := r.Peek(2)
+		if len(next) < 2 || next[0] != 0xFF || next[1]&0xFE != 0xF8 {
+			continue
+		}
+		if h, _ := r.Peek(16); len(h) >= 6 {
+			if _, _, ok := parseFrameHeader(h, si); ok {
+				return data, blocksize, nil
+			}
+		}
+	}
+}
+
+// Reader reads FLAC frames paced by sample count and wraps
+// them in Ogg FLAC pages
+type Reader struct {
+	Info *StreamInfo
+
+	r       *bufio.Reader
+	w       *ogg.Writer
+	samples int64
+	target  int64
+	eof     bool // the input has ended
+	ended   bool // the Ogg stream has ended
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReaderSize(r, 65536)
+	si, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{Info: si, r: br}, nil
+}
+
+// returns the Ogg FLAC header packets
+func (f *Reader) headers() [][]byte {
+	// mapping header, "fLaC" and STREAMINFO
+	first := []byte{0x7F, 'F', 'L', 'A', 'C', 1, 0, 0, 1}
+	first = append(first, "fLaC"...)
+	first = append(first, blockStreamInfo, 0, 0, 34)
+	first = append(first, f.Info.Raw...)
+
+	// a VORBIS_COMMENT block with no comments is required to follow
+	vendor := "goicy"
+	vc := make([]byte, 4, 8+len(vendor))
+	binary.LittleEndian.PutUint32(vc, uint32(len(vendor)))
+	vc = append(vc, vendor...)
+	vc = append(vc, 0, 0, 0, 0)
+	comment := []byte{0x80 | blockVorbisComment, byte(len(vc) >> 16), byte(len(vc) >> 8), byte(len(vc))}
+	comment = append(comment, vc...)
+
+	return [][]byte{first, comment}
+}
+
+// ReadSamples returns Ogg pages with whole frames covering about n more samples.
+// The first call also returns the Ogg FLAC headers. The stream is ended
+// after the last frame of the file.
+func (f *Reader) ReadSamples(n int) ([]byte, error) {
+	var buf []byte
+	if f.w == nil {
+		f.w = ogg.NewWriter()
+		for _, h := range f.headers() {
+			buf = append(buf, f.w.Packet(h, 0)...)
+		}
+	}
+
+	f.target += int64(n)
+	for f.samples < f.target && !f.ended {
+		if f.eof {
+			// the input file has ended
+			buf = append(buf, f.Finish()...)
+			break
+		}
+		frame, blocksize, err := ReadFrame(f.r, f.Info)
+		if err == io.EOF {
+			f.eof = true
+			continue
+		}
+		if err != nil {
+			return buf, err
+		}
+		f.samples += int64(blocksize)
+		buf = append(buf, f.w.Packet(frame, f.samples)...)
+		if f.Info.TotalSamples > 0 && f.samples >= f.Info.TotalSamples {
+			buf = append(buf, f.Finish()...)
+		}
+	}
+	return buf, nil
+}
+
+// Finish returns the page that ends the Ogg FLAC stream, it's nil if the
+// stream was not started or is ended already. It's called when the track
+// is stopped before the end of the file, so the next one starts after a
+// complete stream.
+func (f *Reader) Finish() []byte {
+	if f.w == nil || f.ended {
+		return nil
+	}
+	f.ended = true
+	return f.w.End(f.samples)
+}
+
+// Skip drops the frames covering the first n samples, it has to be
+// called before ReadSamples. The granule positions of the following
+// pages count from the start of the file.
+func (f *Reader) Skip(n int64) error {
+	for f.samples < n {
+		_, blocksize, err := ReadFrame(f.r, f.Info)
+		if err != nil {
+			if err == io.EOF {
+				f.eof = true
+				break
+			}
+			return err
+		}
+		f.samples += int64(blocksize)
+	}
+	f.target = f.samples
+	return nil
+}
+
+// gets information about FLAC file, frames are counted in samples
+// and spf is always 1
+func GetFileInfo(filename string, br *float64, spf, sr, frames, ch *int) error {
+
+	if ok := util.FileExists(filename); !ok {
+		err := new(util.FileError)
+		err.Msg = "File doesn't exist"
+		return err
+	}
+
+	// open file
+	f, err := os.Open(filename)
+	if err != nil {
+		err := new(util.FileError)
+		err.Msg = "Cannot open file"
+		return err
+	}
+
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 65536)
+	si, err := ReadHeader(r)
+	if err != nil {
+		err := new(util.FileError)
+		err.Msg = "Couldn't find FLAC stream"
+		return err
+	}
+
+	samples := si.TotalSamples
+	if samples == 0 {
+		// unknown in STREAMINFO, count the frames
+		for {
+			_, blocksize, err := ReadFrame(r, si)
+			if err != nil {
+				break
+			}
+			samples += int64(blocksize)
+		}
+	}
+
+	finfo, _ := f.Stat()
+	fsize := finfo.Size()
+
+	*spf = 1
+	*sr = si.SampleRate
+	*ch = si.Channels
+	*frames = int(samples)
+	playtime := float64(samples) / float64(si.SampleRate)
+	if playtime > 0 {
+		*br = float64(fsize) / playtime * 8 / 1000
+	}
+
+	logger.Log("samples   : "+strconv.Itoa(*frames), logger.LOG_DEBUG)
+	logger.Log("samplerate: "+strconv.Itoa(*sr)+" Hz", logger.LOG_DEBUG)
+	logger.Log("channels  : "+strconv.Itoa(*ch), logger.LOG_DEBUG)
+	logger.Log("bits      : "+strconv.Itoa(si.BitsPerSample), logger.LOG_DEBUG)
+	logger.Log("blocksize : "+strconv.Itoa(si.MinBlockSize)+"-"+strconv.Itoa(si.MaxBlockSize), logger.LOG_DEBUG)
+	logger.Log("playtime  : "+strconv.Itoa(int(playtime))+" sec", logger.LOG_DEBUG)
+	logger.Log("bitrate   : "+strconv.Itoa(int(*br))+" kbps (average)", logger.LOG_DEBUG)
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package flac
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stunndard/goicy/ogg"
+)
+
+// STREAMINFO of a 44100 Hz 16 bit stereo stream with 4096 sample blocks
+func streamInfo(total int64) []byte {
+	b := make([]byte, 34)
+	binary.BigEndian.PutUint16(b[0:], 4096)
+	binary.BigEndian.PutUint16(b[2:], 4096)
+	b[10], b[11], b[12] = 0x0A, 0xC4, 0x42
+	b[13] = 0xF0 | byte(total>>32&0x0F)
+	binary.BigEndian.PutUint32(b[14:], uint32(total))
+	return b
+}
+
+// frame header with the block size and sample rate codes, n is the frame number
+func frameHeader(bscode, srcode byte, n byte, extra ...byte) []byte {
+	h := []byte{0xFF, 0xF8, bscode<<4 | srcode, 0x18, n}
+	h = append(h, extra...)
+	return append(h, crc8(h))
+}
+
+// a frame of 4096 samples with size bytes of silence
+func frame(n byte, size int) []byte {
+	f := append(frameHeader(12, 9, n), make([]byte, size)...)
+	c := crc16(f)
+	return append(f, byte(c>>8), byte(c))
+}
+
+// a FLAC file with the frames, total is the sample count of STREAMINFO
+func flacFile(total int64, frames int) []byte {
+	b := []byte("fLaC")
+	b = append(b, 0x80|blockStreamInfo, 0, 0, 34)
+	b = append(b, streamInfo(total)...)
+	for i := 0; i < frames; i++ {
+		b = append(b, frame(byte(i), 100+i)...)
+	}
+	return b
+}
+
+func TestCRC(t *testing.T) {
+	if got := crc8([]byte("123456789")); got != 0xF4 {
+		t.Errorf("crc8() = 0x%02X, want 0xF4", got)
+	}
+	if got := crc16([]byte("123456789")); got != 0xFEE8 {
+		t.Errorf("crc16() = 0x%04X, want 0xFEE8", got)
+	}
+}
+
+func TestParseFrameHeader(t *testing.T) {
+	si := parseStreamInfo(streamInfo(0))
+	bad := frameHeader(12, 9, 0)
+	bad[len(bad)-1]++
+	tests := []struct {
+		name     string
+		h        []byte
+		si       *StreamInfo
+		hlen, bs int
+		ok       bool
+	}{
+		{"4096", frameHeader(12, 9, 0), si, 6, 4096, true},
+		{"576", frameHeader(3, 9, 0), si, 6, 1152, true},
+		{"8 bit block size", frameHeader(6, 9, 0, 99), si, 7, 100, true},
+		{"16 bit block size", frameHeader(7, 9, 0, 0x10, 0x00), si, 8, 4097, true},
+		{"2 byte frame number", frameHeader(12, 9, 0xC2, 0x80), si, 7, 4096, true},
+		{"sample rate from STREAMINFO", frameHeader(12, 0, 0), si, 6, 4096, true},
+		{"other sample rate", frameHeader(12, 10, 0), si, 0, 0, false},
+		{"any sample rate without STREAMINFO", frameHeader(12, 10, 0), nil, 6, 4096, true},
+		{"reserved block size", frameHeader(0, 9, 0), si, 0, 0, false},
+		{"bad CRC-8", bad, si, 0, 0, false},
+		{"no sync", append([]byte{0xFF, 0xF0}, frameHeader(12, 9, 0)[2:]...), si, 0, 0, false},
+		{"short", frameHeader(12, 9, 0)[:4], si, 0, 0, false},
+	}
+	for _, tt := range tests {
+		hlen, bs, ok := parseFrameHeader(tt.h, tt.si)
+		if ok != tt.ok || ok && (hlen != tt.hlen || bs != tt.bs) {
+			t.Errorf("parseFrameHeader(%s) = %d, %d, %v, want %d, %d, %v", tt.name, hlen, bs, ok, tt.hlen, tt.bs, tt.ok)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	header := flacFile(0, 0)
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"frames", flacFile(0, 3)},
+		{"garbage before the first frame", append(append(header, "\xFF\xF8garbage"...), flacFile(0, 3)[len(header):]...)},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(bytes.NewReader(tt.file))
+		si, err := ReadHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for {
+			f, bs, err := ReadFrame(r, si)
+			if err != nil {
+				break
+			}
+			if want := frame(byte(n), 100+n); !bytes.Equal(f, want) || bs != 4096 {
+				t.Errorf("ReadFrame(%s) frame %d = %d bytes, block size %d, want %d bytes, 4096", tt.name, n, len(f), bs, len(want))
+			}
+			n++
+		}
+		if n != 3 {
+			t.Errorf("ReadFrame(%s) read %d frames, want 3", tt.name, n)
+		}
+	}
+}
+
+// reads the Ogg pages
+func readPages(b []byte) []*ogg.Page {
+	var pages []*ogg.Page
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		p, err := ogg.ReadPage(r)
+		if err != nil {
+			return pages
+		}
+		pages = append(pages, p)
+	}
+}
+
+// checks the header types and the granules of the pages
+func checkPages(t *testing.T, name string, pages []*ogg.Page, types []byte, granules []int64) {
+	if len(pages) != len(types) {
+		t.Errorf("%s: got %d pages, want %d", name, len(pages), len(types))
+		return
+	}
+	for i, p := range pages {
+		if p.HeaderType != types[i] || p.Granule != granules[i] {
+			t.Errorf("%s: page %d type %d granule %d, want type %d granule %d",
+				name, i, p.HeaderType, p.Granule, types[i], granules[i])
+		}
+	}
+}
+
+func TestReadSamples(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int64
+	}{
+		{"total known", 3 * 4096},
+		{"total unknown", 0},
+	}
+	for _, tt := range tests {
+		f, err := NewReader(bytes.NewReader(flacFile(tt.total, 3)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// headers and the first frame
+		b, err := f.ReadSamples(4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPages(t, tt.name, readPages(b), []byte{ogg.HeaderBOS, 0, 0}, []int64{0, 0, 4096})
+
+		b, err = f.ReadSamples(1 << 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPages(t, tt.name, readPages(b), []byte{0, 0, ogg.HeaderEOS}, []int64{8192, 12288, 12288})
+
+		if b, _ := f.ReadSamples(4096); len(b) != 0 || f.Finish() != nil {
+			t.Errorf("%s: the ended stream returned more data", tt.name)
+		}
+	}
+}
+
+func TestSkipFinish(t *testing.T) {
+	tests := []struct {
+		name     string
+		skip     int64
+		finish   bool // Finish is called after the first read
+		types    []byte
+		granules []int64
+	}{
+		{"skip a frame", 4096, false,
+			[]byte{ogg.HeaderBOS, 0, 0, 0, ogg.HeaderEOS}, []int64{0, 0, 8192, 12288, 12288}},
+		{"skip to the end", 3 * 4096, false,
+			[]byte{ogg.HeaderBOS, 0, ogg.HeaderEOS}, []int64{0, 0, 12288}},
+		{"skip past the end", 10 * 4096, false,
+			[]byte{ogg.HeaderBOS, 0, ogg.HeaderEOS}, []int64{0, 0, 12288}},
+		{"finish", 0, true,
+			[]byte{ogg.HeaderBOS, 0, 0, ogg.HeaderEOS}, []int64{0, 0, 4096, 4096}},
+	}
+	for _, tt := range tests {
+		f, err := NewReader(bytes.NewReader(flacFile(0, 3)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Finish() != nil {
+			t.Errorf("%s: Finish() before the stream started returned a page", tt.name)
+		}
+		if err := f.Skip(tt.skip); err != nil {
+			t.Fatal(err)
+		}
+		var b []byte
+		if tt.finish {
+			b, _ = f.ReadSamples(4096)
+			b = append(b, f.Finish()...)
+		} else {
+			b, _ = f.ReadSamples(1 << 20)
+		}
+		checkPages(t, tt.name, readPages(b), tt.types, tt.granules)
+		if f.Finish() != nil {
+			t.Errorf("%s: Finish() of the ended stream returned a page", tt.name)
+		}
+	}
+}
@@ -1,19 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/stunndard/goicy/config"
 	"github.com/stunndard/goicy/daemon"
 	"github.com/stunndard/goicy/logger"
-	"github.com/stunndard/goicy/playlist"
 	"github.com/stunndard/goicy/stream"
-	"github.com/stunndard/goicy/util"
 
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
-	"time"
 )
 
 func main() {
@@ -25,12 +23,15 @@ func main() {
 	fmt.Println("=====================================================================")
 	fmt.Println()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigs
-		stream.Abort = true
+		cancel()
 		logger.Log("Aborted by user/SIGTERM", logger.LOG_INFO)
 	}()
 
@@ -81,55 +82,6 @@ func main() {
 
 	defer logger.Log("goicy exiting", logger.LOG_INFO)
 
-	if err := playlist.Load(); err != nil {
-		logger.Log("Cannot load playlist file", logger.LOG_ERROR)
-		logger.Log(err.Error(), logger.LOG_ERROR)
-		return
-	}
-
-	retries := 0
-	filename := playlist.First()
-	for {
-		var err error
-		if config.Cfg.StreamType == "file" {
-			err = stream.StreamFile(filename)
-		} else {
-			err = stream.StreamFFMPEG(filename)
-		}
-
-		if err != nil {
-			// if aborted break immediately
-			if stream.Abort {
-				break
-			}
-			retries++
-			logger.Log("Error streaming: "+err.Error(), logger.LOG_ERROR)
-
-			if retries == config.Cfg.ConnAttempts {
-				logger.Log("No more retries", logger.LOG_INFO)
-				break
-			}
-			// if that was a file error
-			switch err.(type) {
-			case *util.FileError:
-				filename = playlist.Next()
-			default:
-
-			}
-
-			logger.Log("Retrying in 10 sec...", logger.LOG_INFO)
-			for i := 0; i < 10; i++ {
-				time.Sleep(time.Second * 1)
-				if stream.Abort {
-					break
-				}
-			}
-			if stream.Abort {
-				break
-			}
-			continue
-		}
-		retries = 0
-		filename = playlist.Next()
-	}
+	streamer := stream.NewStreamer(stream.Options{Config: config.Cfg})
+	streamer.Run(ctx)
 }
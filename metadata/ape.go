@@ -0,0 +1,77 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+)
+
+// APE item types, only text items are read
+const apeItemText = 0
+
+func readAPEv2(f *os.File, tags Tags) error {
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the footer is at the very end or right before ID3v1 tag
+	footer := make([]byte, 32)
+	end := finfo.Size()
+	for _, skip := range []int64{0, 128} {
+		if end-skip < 32 {
+			continue
+		}
+		if _, err := f.ReadAt(footer, end-skip-32); err != nil {
+			return err
+		}
+		if string(footer[0:8]) == "APETAGEX" {
+			end -= skip
+			break
+		}
+	}
+	if string(footer[0:8]) != "APETAGEX" {
+		return errors.New("No APE tag")
+	}
+
+	size := int64(binary.LittleEndian.Uint32(footer[12:]))
+	count := int(binary.LittleEndian.Uint32(footer[16:]))
+	if size < 32 || size > end {
+		return errors.New("Bad APE tag")
+	}
+
+	// the size covers the items and the footer
+	items := make([]byte, size-32)
+	if _, err := f.ReadAt(items, end-size); err != nil {
+		return err
+	}
+
+	for i := 0; i < count && len(items) >= 9; i++ {
+		vsize := int(binary.LittleEndian.Uint32(items))
+		flags := binary.LittleEndian.Uint32(items[4:])
+		keyEnd := bytes.IndexByte(items[8:], 0)
+		if keyEnd < 0 || 8+keyEnd+1+vsize > len(items) {
+			break
+		}
+		key := string(items[8 : 8+keyEnd])
+		value := items[8+keyEnd+1 : 8+keyEnd+1+vsize]
+		items = items[8+keyEnd+1+vsize:]
+
+		if (flags>>1)&0x03 != apeItemText {
+			continue
+		}
+		// multiple values are separated by zero bytes
+		tags.add(apeField(key), strings.Replace(string(value), "\x00", "/", -1))
+	}
+	return nil
+}
+
+// maps APE item keys to tag fields
+func apeField(key string) string {
+	if strings.EqualFold(key, "album artist") {
+		return "albumartist"
+	}
+	return strings.ToLower(key)
+}
@@ -0,0 +1,93 @@
+package metadata
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// output charsets of the servers
+const (
+	CharsetUTF8   = "UTF-8"
+	CharsetLatin1 = "ISO-8859-1"
+)
+
+// Latin Extended-A, U+0100 to U+017F, without diacritics
+var latinExtA = [...]string{
+	"A", "a", "A", "a", "A", "a", "C", "c", "C", "c", "C", "c", "C", "c", "D", "d",
+	"D", "d", "E", "e", "E", "e", "E", "e", "E", "e", "E", "e", "G", "g", "G", "g",
+	"G", "g", "G", "g", "H", "h", "H", "h", "I", "i", "I", "i", "I", "i", "I", "i",
+	"I", "i", "IJ", "ij", "J", "j", "K", "k", "k", "L", "l", "L", "l", "L", "l", "L",
+	"l", "L", "l", "N", "n", "N", "n", "N", "n", "n", "N", "n", "O", "o", "O", "o",
+	"O", "o", "OE", "oe", "R", "r", "R", "r", "R", "r", "S", "s", "S", "s", "S", "s",
+	"S", "s", "T", "t", "T", "t", "T", "t", "U", "u", "U", "u", "U", "u", "U", "u",
+	"U", "u", "U", "u", "W", "w", "Y", "y", "Y", "Z", "z", "Z", "z", "Z", "z", "s",
+}
+
+// Cyrillic, U+0410 to U+044F
+var cyrillic = [...]string{
+	"A", "B", "V", "G", "D", "E", "Zh", "Z", "I", "Y", "K", "L", "M", "N", "O", "P",
+	"R", "S", "T", "U", "F", "Kh", "Ts", "Ch", "Sh", "Shch", "", "Y", "", "E", "Yu", "Ya",
+	"a", "b", "v", "g", "d", "e", "zh", "z", "i", "y", "k", "l", "m", "n", "o", "p",
+	"r", "s", "t", "u", "f", "kh", "ts", "ch", "sh", "shch", "", "y", "", "e", "yu", "ya",
+}
+
+var translit = map[rune]string{
+	'Ё': "Yo", 'ё': "yo", 'Є': "Ye", 'є': "ye", 'І': "I", 'і': "i",
+	'Ї': "Yi", 'ї': "yi", 'Ґ': "G", 'ґ': "g", 'Ў': "U", 'ў': "u",
+	'‘': "'", '’': "'", '‚': ",", '‛': "'", '“': "\"", '”': "\"", '„': "\"",
+	'‐': "-", '‑': "-", '‒': "-", '–': "-", '—': "-", '―': "-",
+	'…': "...", '•': "*", '′': "'", '″': "\"", '€': "EUR", '™': "TM",
+	'\u2002': " ", '\u2003': " ", '\u2009': " ", '\u200B': "",
+}
+
+// CharsetName returns the canonical name of the charset,
+// or empty string if it's not supported
+func CharsetName(charset string) string {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "utf-8", "utf8":
+		return CharsetUTF8
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1":
+		return CharsetLatin1
+	}
+	return ""
+}
+
+// ToUTF8 makes sure the text is UTF-8, text that isn't
+// valid UTF-8 is taken as Latin-1
+func ToUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return decodeLatin1([]byte(s))
+}
+
+// Encode converts UTF-8 text to the charset. The characters that
+// can't be represented are transliterated or replaced with '?'.
+func Encode(s, charset string) string {
+	if CharsetName(charset) != CharsetLatin1 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r < 0x100 {
+			b = append(b, byte(r))
+			continue
+		}
+		b = append(b, Transliterate(r)...)
+	}
+	return string(b)
+}
+
+// Transliterate returns ASCII replacement of the character, or "?"
+func Transliterate(r rune) string {
+	switch {
+	case r >= 0x100 && r < 0x180:
+		return latinExtA[r-0x100]
+	case r >= 0x410 && r < 0x450:
+		return cyrillic[r-0x410]
+	}
+	if t, ok := translit[r]; ok {
+		return t
+	}
+	return "?"
+}
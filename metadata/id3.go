@@ -0,0 +1,294 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ID3v2 header flags
+const (
+	id3Unsync   = 0x80
+	id3Extended = 0x40
+)
+
+// ID3v2 frames mapped to tag fields, v2.2 has 3 character ids
+var id3Frames = map[string]string{
+	"TPE1": "artist", "TP1": "artist",
+	"TIT2": "title", "TT2": "title",
+	"TALB": "album", "TAL": "album",
+	"TYER": "year", "TYE": "year",
+	"TDRC": "year",
+	"TCON": "genre", "TCO": "genre",
+	"TRCK": "track", "TRK": "track",
+	"TPOS": "disc", "TPA": "disc",
+	"TPE2": "albumartist", "TP2": "albumartist",
+	"TCOM": "composer", "TCM": "composer",
+	"TPUB": "publisher", "TPB": "publisher",
+	"TBPM": "bpm", "TBP": "bpm",
+	"COMM": "comment", "COM": "comment",
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// removes unsynchronisation, 0xFF 0x00 becomes 0xFF
+func unsync(b []byte) []byte {
+	return bytes.Replace(b, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+}
+
+// splits text in the encoding at the first terminator
+func splitText(enc byte, b []byte) ([]byte, []byte) {
+	if enc == 1 || enc == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return b[:i], b[i+2:]
+			}
+		}
+		return b, nil
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
+
+func decodeText(enc byte, b []byte) string {
+	switch enc {
+	case 0:
+		return decodeLatin1(b)
+	case 1:
+		return decodeUTF16(b, false)
+	case 2:
+		return decodeUTF16(b, true)
+	default:
+		return string(b)
+	}
+}
+
+// decodes text frame, v2.4 multiple values are joined with '/'
+func textFrame(b []byte) string {
+	if len(b) < 1 {
+		return ""
+	}
+	enc := b[0]
+	b = b[1:]
+	var values []string
+	for len(b) > 0 {
+		var v []byte
+		v, b = splitText(enc, b)
+		if s := decodeText(enc, v); s != "" {
+			values = append(values, s)
+		}
+	}
+	return strings.Join(values, "/")
+}
+
+// decodes COMM and TXXX frames into description and value
+func descFrame(b []byte, lang bool) (string, string) {
+	if len(b) < 1 {
+		return "", ""
+	}
+	enc := b[0]
+	b = b[1:]
+	if lang {
+		if len(b) < 3 {
+			return "", ""
+		}
+		b = b[3:]
+	}
+	desc, value := splitText(enc, b)
+	value, _ = splitText(enc, value)
+	return decodeText(enc, desc), decodeText(enc, value)
+}
+
+func readID3v2(f *os.File, tags Tags) error {
+	header := make([]byte, 10)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if string(header[0:3]) != "ID3" {
+		return errors.New("No ID3v2 tag")
+	}
+	version := header[3]
+	flags := header[5]
+	if version < 2 || version > 4 {
+		return errors.New("Unsupported ID3v2 version")
+	}
+
+	tag := make([]byte, syncsafe(header[6:10]))
+	if _, err := f.ReadAt(tag, 10); err != nil {
+		return err
+	}
+
+	// before v2.4 unsynchronisation is applied to the whole tag
+	if flags&id3Unsync != 0 && version < 4 {
+		tag = unsync(tag)
+	}
+
+	if flags&id3Extended != 0 && version > 2 && len(tag) >= 4 {
+		size := 0
+		if version == 3 {
+			size = int(binary.BigEndian.Uint32(tag)) + 4
+		} else {
+			size = syncsafe(tag)
+		}
+		if size > len(tag) {
+			return errors.New("Bad ID3v2 extended header")
+		}
+		tag = tag[size:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var size int
+		var fflags byte
+		switch version {
+		case 2:
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(tag[4:]))
+			fflags = tag[9]
+		case 4:
+			size = syncsafe(tag[4:])
+			if (tag[4]|tag[5]|tag[6]|tag[7])&0x80 != 0 {
+				// some writers don't use syncsafe sizes in v2.4
+				size = int(binary.BigEndian.Uint32(tag[4:]))
+			}
+			fflags = tag[9]
+		}
+		if headerLen+size > len(tag) {
+			break
+		}
+		data := tag[headerLen : headerLen+size]
+		tag = tag[headerLen+size:]
+
+		if data = id3FrameData(version, fflags, data); data == nil {
+			continue
+		}
+
+		switch {
+		case id == "TXXX" || id == "TXX":
+			desc, value := descFrame(data, false)
+			if desc != "" {
+				tags.add(desc, value)
+			}
+		case id == "COMM" || id == "COM":
+			// comments with descriptions are usually not for humans
+			if desc, value := descFrame(data, true); desc == "" {
+				tags.add("comment", value)
+			}
+		case id3Frames[id] != "":
+			value := textFrame(data)
+			switch id3Frames[id] {
+			case "genre":
+				value = genreName(value)
+			case "year":
+				// v2.4 recording time is a timestamp
+				if len(value) > 4 {
+					value = value[:4]
+				}
+			}
+			tags.add(id3Frames[id], value)
+		}
+	}
+	return nil
+}
+
+// handles frame format flags, returns nil for the frames that can't be read
+func id3FrameData(version, flags byte, data []byte) []byte {
+	compressed := false
+	switch version {
+	case 3:
+		if flags&0x40 != 0 {
+			// encrypted
+			return nil
+		}
+		if flags&0x80 != 0 {
+			// decompressed size
+			compressed = true
+			if len(data) < 4 {
+				return nil
+			}
+			data = data[4:]
+		}
+		if flags&0x20 != 0 && len(data) > 0 {
+			// group id
+			data = data[1:]
+		}
+	case 4:
+		if flags&0x04 != 0 {
+			return nil
+		}
+		if flags&0x40 != 0 && len(data) > 0 {
+			data = data[1:]
+		}
+		if flags&0x01 != 0 && len(data) >= 4 {
+			// data length indicator
+			data = data[4:]
+		}
+		if flags&0x02 != 0 {
+			data = unsync(data)
+		}
+		compressed = flags&0x08 != 0
+	}
+	if compressed {
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		defer r.Close()
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil
+		}
+	}
+	return data
+}
+
+func readID3v1(f *os.File, tags Tags) error {
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if finfo.Size() < 128 {
+		return errors.New("No ID3v1 tag")
+	}
+	tag := make([]byte, 128)
+	if _, err := f.ReadAt(tag, finfo.Size()-128); err != nil {
+		return err
+	}
+	if string(tag[0:3]) != "TAG" {
+		return errors.New("No ID3v1 tag")
+	}
+
+	field := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return decodeLatin1(b)
+	}
+	tags.add("title", field(tag[3:33]))
+	tags.add("artist", field(tag[33:63]))
+	tags.add("album", field(tag[63:93]))
+	tags.add("year", field(tag[93:97]))
+	tags.add("comment", field(tag[97:127]))
+	if tag[125] == 0 && tag[126] != 0 {
+		// ID3v1.1 track number
+		tags.add("track", strconv.Itoa(int(tag[126])))
+	}
+	if int(tag[127]) < len(genres) {
+		tags.add("genre", genres[tag[127]])
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package metadata
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/util"
+)
+
+// how often a watched file is checked for changes
+const watchInterval = time.Second
+
+// Input reads song titles from an external source, like studio
+// automation, one title per line. Repeated titles are ignored and
+// updates are sent not more often than the interval, the latest
+// title wins.
+type Input struct {
+	kind     string // file, fifo, tcp or unix
+	addr     string
+	interval time.Duration
+	send     func(metadata string)
+}
+
+// NewInput creates the input from spec, which is one of
+// file:/path/to/file, fifo:/path/to/fifo, tcp:host:port or
+// unix:/path/to/socket. Every new title is passed to send.
+func NewInput(spec string, interval time.Duration, send func(metadata string)) (*Input, error) {
+	n := strings.IndexByte(spec, ':')
+	if n < 0 || n == len(spec)-1 {
+		return nil, errors.New("Bad metadata input: " + spec)
+	}
+	in := &Input{kind: spec[:n], addr: spec[n+1:], interval: interval, send: send}
+	switch in.kind {
+	case "file", "fifo", "tcp", "unix":
+	default:
+		return nil, errors.New("Unknown metadata input type: " + in.kind)
+	}
+	return in, nil
+}
+
+// Run reads titles until ctx is cancelled
+func (in *Input) Run(ctx context.Context) error {
+	lines := make(chan string, 16)
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		switch in.kind {
+		case "file":
+			err = in.watchFile(ctx, lines)
+		case "fifo":
+			err = in.readFIFO(ctx, lines)
+		default:
+			err = in.listen(ctx, lines)
+		}
+		errc <- err
+	}()
+
+	logger.Log("Reading metadata from "+in.kind+": "+in.addr, logger.LOG_INFO)
+
+	var last, pending string
+	var lastSent time.Time
+	var wait <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return err
+		case line := <-lines:
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			pending = line
+		case <-wait:
+			wait = nil
+		}
+
+		if pending == last {
+			pending = ""
+			continue
+		}
+		if pending == "" || wait != nil {
+			continue
+		}
+		if d := in.interval - time.Since(lastSent); d > 0 {
+			// too soon, send the latest title later
+			wait = time.After(d)
+			continue
+		}
+		in.send(pending)
+		last, pending = pending, ""
+		lastSent = time.Now()
+	}
+}
+
+// checks the file for changes and sends its first line
+func (in *Input) watchFile(ctx context.Context, lines chan<- string) error {
+	var modTime time.Time
+	var size int64 = -1
+	for {
+		if finfo, err := os.Stat(in.addr); err == nil {
+			if !finfo.ModTime().Equal(modTime) || finfo.Size() != size {
+				modTime, size = finfo.ModTime(), finfo.Size()
+				if line, err := firstLine(in.addr); err == nil {
+					select {
+					case lines <- line:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(watchInterval):
+		}
+	}
+}
+
+func firstLine(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			return line, nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// reads lines from the named pipe. It's opened for writing too, so
+// the open doesn't block and there is no EOF when writers go away.
+func (in *Input) readFIFO(ctx context.Context, lines chan<- string) error {
+	f, err := os.OpenFile(in.addr, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	readLines(ctx, f, lines)
+	return ctx.Err()
+}
+
+// accepts connections on tcp or unix socket and reads lines from them
+func (in *Input) listen(ctx context.Context, lines chan<- string) error {
+	return util.Serve(ctx, in.kind, in.addr, func(conn net.Conn) {
+		readLines(ctx, conn, lines)
+	})
+}
+
+func readLines(ctx context.Context, r io.Reader, lines chan<- string) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,55 +1,37 @@
 package metadata
 
 import (
-	"encoding/base64"
 	"github.com/go-ini/ini"
-	"github.com/stunndard/goicy/config"
 	"github.com/stunndard/goicy/logger"
 	"github.com/stunndard/goicy/network"
-	"net/url"
 	"os/exec"
-	"strings"
 )
 
-func FormatMetadata(artist, title string) string {
-	md := ""
-	if artist != "" {
-		md = artist + " - " + title
-	} else {
-		md = title
-	}
-	if md == "" {
-		md = config.Cfg.StreamName
-	}
-	return md
+// FormatMetadata builds the song title with the default template,
+// fallback is used if there are no tags, usually it is the stream name
+func FormatMetadata(artist, title, fallback string) string {
+	return Format(DefaultTemplate, Tags{"artist": artist, "title": title}, fallback)
 }
 
-func SendMetadata(metadata string) error {
+// SendMetadata queues the song title update on all sources,
+// every source sends its updates in order in background,
+// in the charset of the server
+func SendMetadata(sources []*network.Source, metadata string) error {
+	metadata = ToUTF8(metadata)
 	logger.Log("Setting metadata: "+metadata, logger.LOG_INFO)
-	sock, err := network.Connect(config.Cfg.Host, config.Cfg.Port)
-	if err != nil {
-		return err
-	}
-
-	headers := ""
-	if config.Cfg.ServerType == "shoutcast" {
-		headers = "GET /admin.cgi?pass=" + url.QueryEscape(config.Cfg.Password) +
-			"&mode=updinfo&song=" + strings.Replace(url.QueryEscape(metadata), "+", "%20", -1) + " HTTP/1.0\r\n" +
-			"User-Agent: (Mozilla Compatible)\r\n\r\n"
-	} else {
-		headers = "GET /admin/metadata?mode=updinfo&mount=/" + config.Cfg.Mount +
-			"&song=" + strings.Replace(url.QueryEscape(metadata), "+", "%20", -1) + " HTTP/1.0\r\n" +
-			"User-Agent: goicy/" + config.Version + "\r\n" +
-			"Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("source:"+config.Cfg.Password)) + "\r\n\r\n"
-	}
-	if err := network.Send(sock, []byte(headers)); err != nil {
-		return err
-	}
-	return nil
+	var res error
+	for _, src := range sources {
+		if err := src.UpdateMetadata(Encode(metadata, src.Server.Charset)); err != nil {
+			logger.Log("["+src.Name()+"] Error setting metadata: "+err.Error(), logger.LOG_ERROR)
+			res = err
+		}
+	}
+	return res
 }
 
-func GetTagsFFMPEG(filename string) error {
-	cmdName := config.Cfg.FFMPEGPath
+// GetTagsFFMPEG reads the tags of the file using ffmpeg
+func GetTagsFFMPEG(ffmpeg, filename string) (Tags, error) {
+	cmdName := ffmpeg
 	cmdArgs := []string{
 		"-i", filename,
 		"-f", "ffmetadata",
@@ -61,35 +43,19 @@ func GetTagsFFMPEG(filename string) error {
 
 	out, err := cmd.Output()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ini, err := ini.Load(out)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	tags := make(Tags)
 	section, _ := ini.GetSection("")
-	artist := section.Key("artist").Value()
-	if artist == "" {
-		artist = section.Key("ARTIST").Value()
-	}
-
-	title := section.Key("title").Value()
-	if title == "" {
-		title = section.Key("TITLE").Value()
-	}
-
-	logger.Log("Artist: "+artist, logger.LOG_DEBUG)
-	logger.Log("Title: "+title, logger.LOG_DEBUG)
-
-	// format metadata
-	metadata := FormatMetadata(artist, title)
-
-	// send it
-	if err := SendMetadata(metadata); err != nil {
-		return err
+	for _, key := range section.Keys() {
+		tags.add(key.Name(), key.Value())
 	}
 
-	return nil
+	return tags, nil
 }
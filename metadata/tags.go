@@ -0,0 +1,150 @@
+package metadata
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/stunndard/goicy/logger"
+)
+
+// Tags holds the tags of a file by lowercase field name: artist, title,
+// album, year, genre, track, comment and any others found in the file
+type Tags map[string]string
+
+// Get returns the field, or empty string if there is no such field
+func (t Tags) Get(field string) string {
+	return t[strings.ToLower(field)]
+}
+
+// sets the field unless it's already set by a tag read before
+func (t Tags) add(field, value string) {
+	field = strings.ToLower(field)
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if value == "" || t[field] != "" {
+		return
+	}
+	t[field] = value
+}
+
+// ReadTags reads ID3v2, APEv2 and ID3v1 tags of the file, in that
+// order of priority. It fails if there are no tags in the file.
+func ReadTags(filename string) (Tags, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tags := make(Tags)
+	found := false
+	if err := readID3v2(f, tags); err == nil {
+		found = true
+	}
+	if err := readAPEv2(f, tags); err == nil {
+		found = true
+	}
+	if err := readID3v1(f, tags); err == nil {
+		found = true
+	}
+	if !found {
+		return nil, errors.New("No ID3 or APE tags found")
+	}
+	return tags, nil
+}
+
+// GetTags reads the file tags natively and falls back to ffmpeg
+// for the files without ID3 or APE tags, like Ogg, FLAC or MP4
+func GetTags(ffmpeg, filename string) (Tags, error) {
+	tags, err := ReadTags(filename)
+	if err != nil {
+		logger.Log(err.Error()+", trying ffmpeg...", logger.LOG_DEBUG)
+		if tags, err = GetTagsFFMPEG(ffmpeg, filename); err != nil {
+			return nil, err
+		}
+	}
+	logger.Log("Artist: "+tags["artist"], logger.LOG_DEBUG)
+	logger.Log("Title: "+tags["title"], logger.LOG_DEBUG)
+	return tags, nil
+}
+
+func decodeLatin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// decodes UTF-16, big endian unless there's a BOM saying otherwise
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		switch {
+		case b[0] == 0xFF && b[1] == 0xFE:
+			bigEndian = false
+			b = b[2:]
+		case b[0] == 0xFE && b[1] == 0xFF:
+			bigEndian = true
+			b = b[2:]
+		}
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if bigEndian {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		} else {
+			u[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+// resolves ID3 genre numbers like "17" or "(17)" to names
+func genreName(genre string) string {
+	for strings.HasPrefix(genre, "(") {
+		end := strings.IndexByte(genre, ')')
+		if end < 0 {
+			break
+		}
+		n, err := strconv.Atoi(genre[1:end])
+		if err != nil {
+			break
+		}
+		if rest := genre[end+1:]; rest != "" {
+			// refinement follows the number
+			return rest
+		}
+		genre = strconv.Itoa(n)
+	}
+	if n, err := strconv.Atoi(genre); err == nil {
+		if n >= 0 && n < len(genres) {
+			return genres[n]
+		}
+		return ""
+	}
+	return genre
+}
+
+var genres = [...]string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap",
+	"Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks",
+	"Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+	"Folk", "Folk-Rock", "National Folk", "Swing", "Fast Fusion", "Bebob", "Latin", "Revival",
+	"Celtic", "Bluegrass", "Avantgarde", "Gothic Rock", "Progressive Rock", "Psychedelic Rock", "Symphonic Rock", "Slow Rock",
+	"Big Band", "Chorus", "Easy Listening", "Acoustic", "Humour", "Speech", "Chanson", "Opera",
+	"Chamber Music", "Sonata", "Symphony", "Booty Bass", "Primus", "Porn Groove", "Satire", "Slow Jam",
+	"Club", "Tango", "Samba", "Folklore", "Ballad", "Power Ballad", "Rhythmic Soul", "Freestyle",
+	"Duet", "Punk Rock", "Drum Solo", "A capella", "Euro-House", "Dance Hall", "Goa", "Drum & Bass",
+	"Club-House", "Hardcore", "Terror", "Indie", "BritPop", "Negerpunk", "Polsk Punk", "Beat",
+	"Christian Gangsta Rap", "Heavy Metal", "Black Metal", "Crossover", "Contemporary Christian", "Christian Rock", "Merengue", "Salsa",
+	"Thrash Metal", "Anime", "JPop", "Synthpop",
+}
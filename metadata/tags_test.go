@@ -0,0 +1,174 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func id3v1(title, artist, album, year, comment string, track, genre byte) []byte {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[3:33], title)
+	copy(tag[33:63], artist)
+	copy(tag[63:93], album)
+	copy(tag[93:97], year)
+	copy(tag[97:127], comment)
+	if track > 0 {
+		tag[125] = 0
+		tag[126] = track
+	}
+	tag[127] = genre
+	return tag
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+func id3v2(version byte, frames ...[]byte) []byte {
+	var body []byte
+	for _, f := range frames {
+		body = append(body, f...)
+	}
+	// padding
+	body = append(body, make([]byte, 16)...)
+	tag := append([]byte{'I', 'D', '3', version, 0, 0}, syncsafeBytes(len(body))...)
+	return append(tag, body...)
+}
+
+func id3Frame(version byte, id string, data []byte) []byte {
+	var h []byte
+	switch version {
+	case 2:
+		n := len(data)
+		h = append([]byte(id), byte(n>>16), byte(n>>8), byte(n))
+	case 3:
+		h = append([]byte(id), 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(h[4:], uint32(len(data)))
+	case 4:
+		h = append([]byte(id), syncsafeBytes(len(data))...)
+		h = append(h, 0, 0)
+	}
+	return append(h, data...)
+}
+
+// text frame data in the encoding
+func text(enc byte, s string) []byte {
+	return append([]byte{enc}, s...)
+}
+
+func apev2(items ...[2]string) []byte {
+	var body []byte
+	for _, it := range items {
+		item := make([]byte, 8)
+		binary.LittleEndian.PutUint32(item, uint32(len(it[1])))
+		item = append(item, it[0]...)
+		item = append(item, 0)
+		item = append(item, it[1]...)
+		body = append(body, item...)
+	}
+	footer := make([]byte, 32)
+	copy(footer, "APETAGEX")
+	binary.LittleEndian.PutUint32(footer[8:], 2000)
+	binary.LittleEndian.PutUint32(footer[12:], uint32(len(body)+32))
+	binary.LittleEndian.PutUint32(footer[16:], uint32(len(items)))
+	return append(body, footer...)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestReadTags(t *testing.T) {
+	audio := make([]byte, 1000)
+	tests := []struct {
+		name string
+		file []byte
+		want Tags // nil if there are no tags
+	}{
+		{"no tags", audio, nil},
+		{"ID3v1", concat(audio, id3v1("Title", "Artist", "Album", "1999", "", 0, 17)),
+			Tags{"title": "Title", "artist": "Artist", "album": "Album", "year": "1999", "genre": "Rock"}},
+		{"ID3v1.1 Latin-1", concat(audio, id3v1("Caf\xe9", "Artist", "", "", "comment", 5, 255)),
+			Tags{"title": "Café", "artist": "Artist", "comment": "comment", "track": "5"}},
+		{"ID3v2.2", concat(id3v2(2,
+			id3Frame(2, "TT2", text(0, "Title")),
+			id3Frame(2, "TP1", text(0, "Artist")),
+			id3Frame(2, "TCO", text(0, "(17)"))), audio),
+			Tags{"title": "Title", "artist": "Artist", "genre": "Rock"}},
+		{"ID3v2.3 UTF-16", concat(id3v2(3,
+			id3Frame(3, "TIT2", text(1, "\xFF\xFET\x00\xEF\x00t\x00l\x00e\x00")),
+			id3Frame(3, "TPE1", text(0, "Artist")),
+			id3Frame(3, "TXXX", text(0, "MOOD\x00calm")),
+			id3Frame(3, "COMM", text(0, "eng\x00a comment"))), audio),
+			Tags{"title": "Tïtle", "artist": "Artist", "mood": "calm", "comment": "a comment"}},
+		{"ID3v2.4 UTF-8 multiple values", concat(id3v2(4,
+			id3Frame(4, "TIT2", text(3, "Título")),
+			id3Frame(4, "TPE1", text(3, "One\x00Two")),
+			id3Frame(4, "TDRC", text(3, "2001-05-01"))), audio),
+			Tags{"title": "Título", "artist": "One/Two", "year": "2001"}},
+		{"ID3v2 frame past the tag", concat([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, 12},
+			id3Frame(3, "TIT2", text(0, "Title that doesn't fit"))[:12], audio),
+			Tags{}},
+		{"APEv2", concat(audio, apev2([2]string{"Title", "Title"}, [2]string{"Album Artist", "Various"})),
+			Tags{"title": "Title", "albumartist": "Various"}},
+		{"APEv2 before ID3v1", concat(audio, apev2([2]string{"Artist", "APE"}),
+			id3v1("Title", "ID3", "", "", "", 0, 255)),
+			Tags{"title": "Title", "artist": "APE"}},
+		{"ID3v2 over ID3v1", concat(id3v2(3, id3Frame(3, "TIT2", text(0, "v2"))), audio,
+			id3v1("v1", "Artist", "", "", "", 0, 255)),
+			Tags{"title": "v2", "artist": "Artist"}},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		filename := filepath.Join(dir, "test"+string(rune('a'+i))+".mp3")
+		if err := ioutil.WriteFile(filename, tt.file, 0644); err != nil {
+			t.Fatal(err)
+		}
+		tags, err := ReadTags(filename)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ReadTags(%s) = %v, want error", tt.name, tags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadTags(%s) failed: %v", tt.name, err)
+			continue
+		}
+		if len(tags) != len(tt.want) {
+			t.Errorf("ReadTags(%s) = %v, want %v", tt.name, tags, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if tags[k] != v {
+				t.Errorf("ReadTags(%s) %s = %q, want %q", tt.name, k, tags[k], v)
+			}
+		}
+	}
+}
+
+func TestGenreName(t *testing.T) {
+	tests := []struct {
+		genre, want string
+	}{
+		{"17", "Rock"},
+		{"(17)", "Rock"},
+		{"(17)Indie Rock", "Indie Rock"},
+		{"((17))", "((17))"},
+		{"Jazz", "Jazz"},
+		{"999", ""},
+	}
+	for _, tt := range tests {
+		if got := genreName(tt.genre); got != tt.want {
+			t.Errorf("genreName(%q) = %q, want %q", tt.genre, got, tt.want)
+		}
+	}
+}
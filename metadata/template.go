@@ -0,0 +1,72 @@
+package metadata
+
+import (
+	"strings"
+)
+
+// DefaultTemplate is the song title format used if none is configured
+const DefaultTemplate = "[{artist} - ]{title}"
+
+// Format fills the template with the fields, fallback is used if
+// the result is empty, usually it is the stream name.
+//
+// {field} is replaced with the value of the field. [...] is a conditional
+// section, it is left out if any field in it is empty. Sections can be
+// nested, \ makes the next character literal, like \[ or \{.
+func Format(template string, fields Tags, fallback string) string {
+	if template == "" {
+		template = DefaultTemplate
+	}
+	md, _, _ := format(template, 0, 0, fields)
+	md = strings.TrimSpace(md)
+	if md == "" {
+		md = fallback
+	}
+	return md
+}
+
+// formats the template from pos to the end of the current section,
+// returns the text, whether all its fields were set and the position
+// right after the section
+func format(t string, pos, depth int, fields Tags) (string, bool, int) {
+	var b strings.Builder
+	ok := true
+	for pos < len(t) {
+		switch c := t[pos]; c {
+		case '\\':
+			if pos+1 < len(t) {
+				b.WriteByte(t[pos+1])
+			}
+			pos += 2
+		case '{':
+			end := strings.IndexByte(t[pos:], '}')
+			if end < 0 {
+				b.WriteString(t[pos:])
+				pos = len(t)
+				continue
+			}
+			value := fields.Get(strings.TrimSpace(t[pos+1 : pos+end]))
+			if value == "" {
+				ok = false
+			}
+			b.WriteString(value)
+			pos += end + 1
+		case '[':
+			section, set, next := format(t, pos+1, depth+1, fields)
+			if set {
+				b.WriteString(section)
+			}
+			pos = next
+		case ']':
+			if depth > 0 {
+				return b.String(), ok, pos + 1
+			}
+			b.WriteByte(c)
+			pos++
+		default:
+			b.WriteByte(c)
+			pos++
+		}
+	}
+	return b.String(), ok, pos
+}
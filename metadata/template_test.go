@@ -0,0 +1,36 @@
+package metadata
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	fields := Tags{"artist": "Artist", "title": "Title", "album": "Album", "year": "1999"}
+	tests := []struct {
+		template string
+		fields   Tags
+		want     string
+	}{
+		{"", fields, "Artist - Title"},
+		{"", Tags{"title": "Title"}, "Title"},
+		{"{title}", fields, "Title"},
+		{"{ title }", fields, "Title"},
+		{"{TITLE}", fields, "Title"},
+		{"{artist} - {title}", Tags{"title": "Title"}, "- Title"},
+		{"[{artist} - ]{title}[ \\[{album}\\]]", fields, "Artist - Title [Album]"},
+		{"[{artist} - ]{title}[ \\[{album}\\]]", Tags{"title": "Title"}, "Title"},
+		{"{title}[ ({album}[, {year}])]", fields, "Title (Album, 1999)"},
+		{"{title}[ ({album}[, {year}])]", Tags{"title": "Title", "album": "Album"}, "Title (Album)"},
+		{"{title}[ ({album}[, {year}])]", Tags{"title": "Title", "year": "1999"}, "Title"},
+		{"[{artist}]", Tags{}, "Stream"},
+		{"{missing}", fields, "Stream"},
+		{"\\{title\\}", fields, "{title}"},
+		{"{title", fields, "{title"},
+		{"{title}]", fields, "Title]"},
+		{"[{title}", fields, "Title"},
+		{"{title}\\", fields, "Title"},
+	}
+	for _, tt := range tests {
+		if got := Format(tt.template, tt.fields, "Stream"); got != tt.want {
+			t.Errorf("Format(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
@@ -193,6 +193,13 @@ func getFrameSize(header []byte) int {
 }
 
 func SeekTo1StFrame(f os.File) int64 {
+	pos, _ := seekTo1StFrame(f)
+	return pos
+}
+
+// seeks to the first audio frame, skipping Xing/Info/VBRI frame if any,
+// and returns its position and the VBR header
+func seekTo1StFrame(f os.File) (int64, *VBRHeader) {
 
 	buf := make([]byte, 100000)
 	f.ReadAt(buf, 0)
@@ -209,6 +216,7 @@ func SeekTo1StFrame(f os.File) int64 {
 	}
 
 	pos := int64(-1)
+	var vbr *VBRHeader
 
 	for i := 0; i < len(buf); i++ {
 		if (buf[i] == 0xFF) && ((buf[i+1] & 0xE0) == 0xE0) {
@@ -224,6 +232,10 @@ func SeekTo1StFrame(f os.File) int64 {
 					mpx_header = buf[i+framelength : i+framelength+4]
 					if _, ok := isValidFrameHeader(mpx_header); ok {
 						pos = int64(i) + ID3Length
+						if vbr = ParseVBRHeader(buf[i : i+framelength]); vbr != nil {
+							// the header frame carries no audio, don't stream it
+							pos += int64(framelength)
+						}
 						f.Seek(pos, 0)
 						break
 					}
@@ -231,7 +243,7 @@ func SeekTo1StFrame(f os.File) int64 {
 			}
 		}
 	}
-	return pos
+	return pos, vbr
 }
 
 func GetFrames(f os.File, framesToRead int) ([]byte, error) {
@@ -406,7 +418,7 @@ func GetFileInfo(filename string, br *float64, spf, sr, frames, ch *int) error {
 
 	defer f.Close()
 
-	firstFramePos := SeekTo1StFrame(*f)
+	firstFramePos, vbr := seekTo1StFrame(*f)
 	if firstFramePos == -1 {
 		err := new(util.FileError)
 		err.Msg = "Couldn't find MPEG frame"
@@ -414,6 +426,13 @@ func GetFileInfo(filename string, br *float64, spf, sr, frames, ch *int) error {
 	}
 
 	logger.Log("First frame found at offset: "+strconv.Itoa(int(firstFramePos)), logger.LOG_DEBUG)
+	if vbr != nil {
+		logger.Log(vbr.Tag+" header found, frames: "+strconv.Itoa(vbr.Frames), logger.LOG_DEBUG)
+		if vbr.Encoder != "" {
+			logger.Log("encoder   : "+vbr.Encoder+", delay "+strconv.Itoa(vbr.Delay)+
+				", padding "+strconv.Itoa(vbr.Padding), logger.LOG_DEBUG)
+		}
+	}
 
 	// now having opened the input file, read the fixed header of the
 	// first frame, to get the audio stream's parameters:
@@ -475,7 +494,14 @@ func GetFileInfo(filename string, br *float64, spf, sr, frames, ch *int) error {
 
 		var numBytesToRead int = 0
 
-		for {
+		// the exact frame count is known from VBR header, no need to scan
+		scan := true
+		if vbr != nil && vbr.Frames > 0 {
+			frame = vbr.Frames + 1
+			scan = false
+		}
+
+		for scan {
 			if n, err = f.Read(header); (n < len(header)) || (err != nil) {
 				// the input file has ended
 				break
@@ -533,9 +559,21 @@ func GetFileInfo(filename string, br *float64, spf, sr, frames, ch *int) error {
 	fsize := finfo.Size()
 	*frames = frame - 1
 	nsamples := *spf * *frames
-	playtime := nsamples / *sr
-	*br = float64((fsize - firstFramePos)) / float64(playtime)
-	*br = *br * 8 / 1000
+	if vbr != nil && nsamples > vbr.Delay+vbr.Padding {
+		// exact playtime without encoder delay and padding,
+		// whole frames of padding at the end are not streamed,
+		// the delay at the start is streamed as is
+		nsamples -= vbr.Delay + vbr.Padding
+		*frames -= vbr.Padding / *spf
+	}
+	playtime := float64(nsamples) / float64(*sr)
+	bytes := fsize - firstFramePos
+	if vbr != nil && vbr.Bytes > 0 {
+		bytes = int64(vbr.Bytes)
+	}
+	if playtime > 0 {
+		*br = float64(bytes) / playtime * 8 / 1000
+	}
 
 	var smpegver string
 	switch mpegver {
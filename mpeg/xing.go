@@ -0,0 +1,105 @@
+package mpeg
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Xing/Info header flags
+const (
+	xingFrames = 0x01
+	xingBytes  = 0x02
+	xingTOC    = 0x04
+	xingScale  = 0x08
+)
+
+// VBRHeader is the Xing/Info or VBRI header found in the first frame
+// of the file. That frame carries no audio. Delay and Padding are only
+// partly applied: the frames are streamed whole, so just whole frames of
+// padding are trimmed at the end. The delay is never trimmed, the first
+// frames hold the bit reservoir of the following ones.
+type VBRHeader struct {
+	Tag     string // Xing, Info or VBRI
+	Frames  int    // number of audio frames, without the header frame
+	Bytes   int    // size of the audio in bytes, 0 if unknown
+	Encoder string // LAME encoder version, if any
+	Delay   int    // encoder delay in samples, from LAME tag
+	Padding int    // encoder padding in samples, from LAME tag
+}
+
+// offset of Xing header, right after the side information
+func xingOffset(header []byte) int {
+	mpegver := (header[1] & 0x18) >> 3
+	mono := (header[3]&0xC0)>>6 == 3
+	switch {
+	case mpegver == 3 && !mono:
+		return 4 + 32
+	case mpegver == 3 && mono:
+		return 4 + 17
+	case !mono:
+		return 4 + 17
+	default:
+		return 4 + 9
+	}
+}
+
+// ParseVBRHeader returns the VBR header of the frame, or nil if there is none
+func ParseVBRHeader(frame []byte) *VBRHeader {
+	if len(frame) < 4 {
+		return nil
+	}
+
+	// Xing or Info, only layer III has it
+	if layer := (frame[1] & 0x06) >> 1; layer == 1 {
+		pos := xingOffset(frame)
+		if pos+8 <= len(frame) {
+			if tag := string(frame[pos : pos+4]); tag == "Xing" || tag == "Info" {
+				return parseXing(tag, frame[pos+4:])
+			}
+		}
+	}
+
+	// VBRI by Fraunhofer is always 32 bytes after the frame header
+	if len(frame) >= 4+32+18 && string(frame[36:40]) == "VBRI" {
+		v := frame[40:]
+		return &VBRHeader{
+			Tag:    "VBRI",
+			Bytes:  int(binary.BigEndian.Uint32(v[6:])),
+			Frames: int(binary.BigEndian.Uint32(v[10:])),
+		}
+	}
+	return nil
+}
+
+func parseXing(tag string, b []byte) *VBRHeader {
+	vbr := &VBRHeader{Tag: tag}
+	flags := binary.BigEndian.Uint32(b)
+	pos := 4
+	if flags&xingFrames != 0 && pos+4 <= len(b) {
+		vbr.Frames = int(binary.BigEndian.Uint32(b[pos:]))
+		pos += 4
+	}
+	if flags&xingBytes != 0 && pos+4 <= len(b) {
+		vbr.Bytes = int(binary.BigEndian.Uint32(b[pos:]))
+		pos += 4
+	}
+	if flags&xingTOC != 0 {
+		pos += 100
+	}
+	if flags&xingScale != 0 {
+		pos += 4
+	}
+
+	// LAME extension: encoder version, then delay and padding
+	// 12 bits each at offset 21
+	if pos+24 <= len(b) {
+		encoder := string(b[pos : pos+9])
+		if strings.HasPrefix(encoder, "LAME") || strings.HasPrefix(encoder, "Lavc") || strings.HasPrefix(encoder, "Lavf") {
+			vbr.Encoder = strings.TrimRight(encoder, "\x00 ")
+			d := b[pos+21:]
+			vbr.Delay = int(d[0])<<4 | int(d[1])>>4
+			vbr.Padding = int(d[1]&0x0F)<<8 | int(d[2])
+		}
+	}
+	return vbr
+}
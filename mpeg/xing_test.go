@@ -0,0 +1,83 @@
+package mpeg
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// builds a 417 byte frame with the tag at the offset
+func vbrFrame(header []byte, offset int, tag []byte) []byte {
+	frame := make([]byte, 417)
+	copy(frame, header)
+	copy(frame[offset:], tag)
+	return frame
+}
+
+// builds a Xing/Info tag with frames and bytes and an optional LAME extension
+func xingTag(tag string, frames, bytes uint32, lame bool) []byte {
+	b := make([]byte, 16)
+	copy(b, tag)
+	binary.BigEndian.PutUint32(b[4:], xingFrames|xingBytes)
+	binary.BigEndian.PutUint32(b[8:], frames)
+	binary.BigEndian.PutUint32(b[12:], bytes)
+	if lame {
+		ext := make([]byte, 24)
+		copy(ext, "LAME3.100")
+		// delay 576, padding 1000
+		copy(ext[21:], []byte{0x24, 0x03, 0xE8})
+		b = append(b, ext...)
+	}
+	return b
+}
+
+func vbriTag(frames, bytes uint32) []byte {
+	b := make([]byte, 4+14)
+	copy(b, "VBRI")
+	binary.BigEndian.PutUint32(b[4+6:], bytes)
+	binary.BigEndian.PutUint32(b[4+10:], frames)
+	return b
+}
+
+func TestParseVBRHeader(t *testing.T) {
+	stereo := []byte{0xFF, 0xFB, 0x90, 0x00} // MPEG1 layer III, stereo
+	mono := []byte{0xFF, 0xFB, 0x90, 0xC0}   // MPEG1 layer III, mono
+	mpeg2 := []byte{0xFF, 0xF3, 0x90, 0x00}  // MPEG2 layer III, stereo
+	layer2 := []byte{0xFF, 0xFD, 0x90, 0x00} // MPEG1 layer II
+	tests := []struct {
+		name  string
+		frame []byte
+		want  *VBRHeader
+	}{
+		{"Xing stereo", vbrFrame(stereo, 36, xingTag("Xing", 1000, 400000, false)),
+			&VBRHeader{Tag: "Xing", Frames: 1000, Bytes: 400000}},
+		{"Info mono", vbrFrame(mono, 21, xingTag("Info", 500, 0, false)),
+			&VBRHeader{Tag: "Info", Frames: 500}},
+		{"Xing MPEG2", vbrFrame(mpeg2, 21, xingTag("Xing", 700, 1234, false)),
+			&VBRHeader{Tag: "Xing", Frames: 700, Bytes: 1234}},
+		{"Xing with LAME", vbrFrame(stereo, 36, xingTag("Xing", 1000, 400000, true)),
+			&VBRHeader{Tag: "Xing", Frames: 1000, Bytes: 400000, Encoder: "LAME3.100", Delay: 576, Padding: 1000}},
+		{"VBRI", vbrFrame(stereo, 36, vbriTag(2000, 800000)),
+			&VBRHeader{Tag: "VBRI", Frames: 2000, Bytes: 800000}},
+		{"Xing at the mono offset of a stereo frame", vbrFrame(stereo, 21, xingTag("Xing", 1000, 400000, false)), nil},
+		{"Xing in layer II", vbrFrame(layer2, 36, xingTag("Xing", 1000, 400000, false)), nil},
+		{"no tag", vbrFrame(stereo, 36, nil), nil},
+		{"short frame", stereo, nil},
+		{"truncated Xing", vbrFrame(stereo, 36, []byte("Xing"))[:40], nil},
+	}
+	for _, tt := range tests {
+		got := ParseVBRHeader(tt.frame)
+		if tt.want == nil {
+			if got != nil {
+				t.Errorf("ParseVBRHeader(%s) = %+v, want nil", tt.name, *got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("ParseVBRHeader(%s) = nil, want %+v", tt.name, *tt.want)
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("ParseVBRHeader(%s) = %+v, want %+v", tt.name, *got, *tt.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package network
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stunndard/goicy/config"
+	"github.com/stunndard/goicy/logger"
+)
+
+// how many times a failed metadata update is retried
+const metadataRetries = 3
+
+// how long to wait before retrying a failed metadata update
+const metadataRetryDelay = 2 * time.Second
+
+// UpdateMetadata queues the song title to be set on the server and
+// returns immediately. The updates of a source are sent one by one in
+// order, the server response is checked and failed updates are retried.
+// A newer title replaces the one still waiting to be sent.
+func (s *Source) UpdateMetadata(metadata string) error {
+	s.mdMu.Lock()
+	defer s.mdMu.Unlock()
+	s.mdNext, s.mdQueued = metadata, true
+	if !s.mdRunning {
+		s.mdRunning = true
+		go s.metadataDispatcher()
+	}
+	return nil
+}
+
+// sends the queued updates, exits when there are none left
+func (s *Source) metadataDispatcher() {
+	for {
+		s.mdMu.Lock()
+		if !s.mdQueued {
+			s.mdRunning = false
+			s.mdMu.Unlock()
+			return
+		}
+		metadata := s.mdNext
+		s.mdQueued = false
+		s.mdMu.Unlock()
+
+		s.sendMetadata(metadata)
+	}
+}
+
+func (s *Source) newerMetadata() bool {
+	s.mdMu.Lock()
+	defer s.mdMu.Unlock()
+	return s.mdQueued
+}
+
+// sets the song title, retrying until it succeeds or a newer one is queued
+func (s *Source) sendMetadata(metadata string) {
+	for attempt := 1; ; attempt++ {
+		err := s.setMetadata(metadata)
+		if err == nil {
+			logger.Log("["+s.Name()+"] Metadata set: "+metadata, logger.LOG_DEBUG)
+			return
+		}
+		logger.Log("["+s.Name()+"] Error setting metadata (attempt "+strconv.Itoa(attempt)+"): "+
+			err.Error(), logger.LOG_ERROR)
+		if attempt > metadataRetries {
+			logger.Log("["+s.Name()+"] Giving up setting metadata: "+metadata, logger.LOG_ERROR)
+			return
+		}
+		time.Sleep(metadataRetryDelay)
+		if s.newerMetadata() {
+			return
+		}
+	}
+}
+
+// sets the song title on the server and checks the response
+func (s *Source) setMetadata(metadata string) error {
+	srv := &s.Server
+	if srv.ServerType == "shoutcast2" {
+		// Ultravox carries metadata in-band with the stream,
+		// the server doesn't answer it
+		s.mu.Lock()
+		c := s.conn
+		s.mu.Unlock()
+		var sock net.Conn
+		if c != nil {
+			sock = c.socket()
+		}
+		if sock == nil {
+			return errors.New("Not connected to Shoutcast v2 server")
+		}
+		return sendUvoxMetadata(sock.(*uvoxConn), metadata)
+	}
+
+	sock, err := Connect(srv, srv.Port)
+	if err != nil {
+		return err
+	}
+	defer Close(sock)
+
+	headers := ""
+	if srv.ServerType == "shoutcast" {
+		headers = "GET /admin.cgi?pass=" + url.QueryEscape(srv.Password) +
+			"&mode=updinfo&song=" + strings.Replace(url.QueryEscape(metadata), "+", "%20", -1) + " HTTP/1.0\r\n" +
+			"User-Agent: (Mozilla Compatible)\r\n\r\n"
+	} else {
+		headers = "GET /admin/metadata?mode=updinfo&mount=/" + srv.Mount +
+			"&song=" + strings.Replace(url.QueryEscape(metadata), "+", "%20", -1) +
+			"&charset=" + url.QueryEscape(charset(srv)) + " HTTP/1.0\r\n" +
+			"User-Agent: goicy/" + config.Version + "\r\n" +
+			"Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("source:"+srv.Password)) + "\r\n\r\n"
+	}
+	if err := Send(sock, []byte(headers)); err != nil {
+		return err
+	}
+
+	resp, err := readResponse(sock)
+	if err != nil {
+		return err
+	}
+	if resp.Code != 200 {
+		return checkResponse(resp)
+	}
+
+	// the body is short, the server closes the connection after it
+	sock.SetReadDeadline(time.Now().Add(10 * time.Second))
+	body, err := ioutil.ReadAll(io.LimitReader(sock, 65536))
+	if err != nil && len(body) == 0 {
+		return err
+	}
+	return checkMetadataResponse(srv.ServerType, string(body))
+}
+
+// charset of the metadata sent to the server
+func charset(srv *config.Server) string {
+	if srv.Charset == "" {
+		return "UTF-8"
+	}
+	return srv.Charset
+}
+
+// checks the body of metadata update response
+func checkMetadataResponse(serverType, body string) error {
+	if serverType == "shoutcast" {
+		// admin.cgi answers 200 with an html page even if it refuses
+		lbody := strings.ToLower(body)
+		if strings.Contains(lbody, "invalid password") || strings.Contains(lbody, "unauthorized") {
+			return &ServerError{Code: 401, Msg: "Authentication failed, check the admin password"}
+		}
+		return nil
+	}
+
+	// icecast answers <iceresponse><message>...</message><return>1</return></iceresponse>
+	ret := xmlValue(body, "return")
+	if ret == "" || ret == "1" {
+		return nil
+	}
+	msg := xmlValue(body, "message")
+	if msg == "" {
+		msg = "return " + ret
+	}
+	return &ServerError{Code: 200, Msg: "Metadata update refused: " + msg}
+}
+
+// returns the text of the first element with the name
+func xmlValue(body, name string) string {
+	start := strings.Index(body, "<"+name+">")
+	if start < 0 {
+		return ""
+	}
+	start += len(name) + 2
+	end := strings.Index(body[start:], "</"+name+">")
+	if end < 0 {
+		return ""
+	}
+	return strings.TrimSpace(body[start : start+end])
+}
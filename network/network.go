@@ -1,24 +1,108 @@
 package network
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/stunndard/goicy/config"
 	"github.com/stunndard/goicy/logger"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
-var Connected bool = false
-var csock net.Conn
+// ServerError is returned when the server explicitly refuses the source
+type ServerError struct {
+	Code int
+	Msg  string
+}
 
-func Connect(host string, port int) (net.Conn, error) {
-	h := host + ":" + strconv.Itoa(int(port))
-	sock, err := net.Dial("tcp", h)
-	if err != nil {
-		Connected = false
+func (e *ServerError) Error() string {
+	return e.Msg
+}
+
+type response struct {
+	Proto   string
+	Code    int
+	Reason  string
+	Headers map[string]string
+}
+
+// chunkedConn sends everything written to it as HTTP/1.1 chunks
+type chunkedConn struct {
+	net.Conn
+}
+
+func (c *chunkedConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	chunk := make([]byte, 0, len(b)+16)
+	chunk = append(chunk, strconv.FormatInt(int64(len(b)), 16)+"\r\n"...)
+	chunk = append(chunk, b...)
+	chunk = append(chunk, "\r\n"...)
+	if _, err := c.Conn.Write(chunk); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *chunkedConn) Close() error {
+	// terminating zero-length chunk
+	c.Conn.Write([]byte("0\r\n\r\n"))
+	return c.Conn.Close()
+}
+
+// builds TLS client settings of the server
+func tlsConfig(srv *config.Server) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         srv.Host,
+		InsecureSkipVerify: !srv.TLSVerify,
+	}
+	if srv.TLSServerName != "" {
+		tc.ServerName = srv.TLSServerName
+	}
+
+	if srv.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(srv.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if ok := pool.AppendCertsFromPEM(pem); !ok {
+			return nil, errors.New("No certificates found in CA file " + srv.TLSCAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if srv.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(srv.TLSCertFile, srv.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+func Connect(srv *config.Server, port int) (net.Conn, error) {
+	var sock net.Conn
+	var err error
+
+	h := srv.Host + ":" + strconv.Itoa(int(port))
+	// a dead server doesn't hold the connection for the system timeout
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if srv.TLS {
+		var tc *tls.Config
+		if tc, err = tlsConfig(srv); err == nil {
+			sock, err = tls.DialWithDialer(dialer, "tcp", h, tc)
+		}
+	} else {
+		sock, err = dialer.Dial("tcp", h)
 	}
 	return sock, err
 }
@@ -26,11 +110,9 @@ func Connect(host string, port int) (net.Conn, error) {
 func Send(sock net.Conn, buf []byte) error {
 	n, err := sock.Write(buf)
 	if err != nil {
-		Connected = false
 		return err
 	}
 	if n != len(buf) {
-		Connected = false
 		return errors.New("Send() error")
 	}
 	return nil
@@ -48,27 +130,123 @@ func Recv(sock net.Conn) ([]byte, error) {
 	return buf[0:n], err
 }
 
+// reads HTTP response status line and headers, byte by byte,
+// so nothing that follows the headers is consumed
+func readResponse(sock net.Conn) (*response, error) {
+	sock.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer sock.SetReadDeadline(time.Time{})
+
+	var raw []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(raw), "\r\n\r\n") && !strings.HasSuffix(string(raw), "\n\n") {
+		n, err := sock.Read(b)
+		if n > 0 {
+			raw = append(raw, b[0])
+		}
+		if err != nil {
+			if len(raw) > 0 {
+				break
+			}
+			return nil, err
+		}
+		if len(raw) > 8192 {
+			return nil, errors.New("Server response headers too long")
+		}
+	}
+	return parseResponse(string(raw))
+}
+
+func parseResponse(raw string) (*response, error) {
+	lines := strings.Split(strings.Replace(raw, "\r\n", "\n", -1), "\n")
+
+	// status line: HTTP/1.0 200 OK
+	status := strings.SplitN(strings.TrimSpace(lines[0]), " ", 3)
+	if len(status) < 2 || !strings.HasPrefix(status[0], "HTTP/") {
+		return nil, errors.New("Invalid server response: " + strings.TrimSpace(raw))
+	}
+	code, err := strconv.Atoi(status[1])
+	if err != nil {
+		return nil, errors.New("Invalid server response: " + strings.TrimSpace(raw))
+	}
+	resp := &response{
+		Proto:   status[0],
+		Code:    code,
+		Headers: make(map[string]string),
+	}
+	if len(status) > 2 {
+		resp.Reason = status[2]
+	}
+
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		resp.Headers[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return resp, nil
+}
+
+// converts refusing server responses to errors
+func checkResponse(resp *response) error {
+	switch resp.Code {
+	case 100, 200:
+		return nil
+	case 401:
+		return &ServerError{Code: resp.Code, Msg: "Authentication failed, check the source password: " + resp.Reason}
+	case 403:
+		if strings.Contains(strings.ToLower(resp.Reason), "in use") {
+			return &ServerError{Code: 409, Msg: "Mountpoint in use: " + resp.Reason}
+		}
+		return &ServerError{Code: resp.Code, Msg: "Access forbidden: " + resp.Reason}
+	case 409:
+		return &ServerError{Code: resp.Code, Msg: "Mountpoint in use: " + resp.Reason}
+	}
+	return &ServerError{Code: resp.Code, Msg: "Unexpected server response: " + strconv.Itoa(resp.Code) + " " + resp.Reason}
+}
+
 func Close(sock net.Conn) {
-	Connected = false
+	if sock == nil {
+		return
+	}
 	sock.Close()
 }
 
-func ConnectServer(host string, port int, br float64, sr, ch int) (net.Conn, error) {
-	var sock net.Conn
+// returns MIME type of the stream format
+func contentType(format string) string {
+	switch format {
+	case "mpeg":
+		return "audio/mpeg"
+	case "ogg":
+		return "application/ogg"
+	case "vorbis", "opus", "flac":
+		return "audio/ogg"
+	}
+	return "audio/aacp"
+}
 
-	if Connected {
-		return csock, nil
+// returns the public flag of the stream headers
+func public(cfg *config.Config) string {
+	if cfg.StreamPublic {
+		return "1"
 	}
+	return "0"
+}
 
-	if config.Cfg.ServerType == "shoutcast" {
+// connects and logs in to the server, returns the socket
+// ready to receive the stream
+func connectServer(srv *config.Server, cfg *config.Config, br float64, sr, ch int) (net.Conn, error) {
+	var sock net.Conn
+
+	port := srv.Port
+	if srv.ServerType == "shoutcast" {
 		port++
 	}
-	logger.Log("Connecting to "+config.Cfg.ServerType+" at "+host+":"+strconv.Itoa(port)+"...", logger.LOG_DEBUG)
-	sock, err := Connect(host, port)
+	logger.Log("["+srv.Name+"] Connecting to "+srv.ServerType+" at "+srv.Host+":"+strconv.Itoa(port)+"...", logger.LOG_DEBUG)
+	sock, err := Connect(srv, port)
 
 	if err != nil {
-		Connected = false
-		return sock, err
+		return nil, err
 	}
 
 	//fmt.Println("connected ok")
@@ -79,28 +257,33 @@ func ConnectServer(host string, port int, br float64, sr, ch int) (net.Conn, err
 	samplerate := 0
 	channels := 0
 
-	if config.Cfg.StreamType == "file" {
+	if cfg.StreamType == "file" {
 		bitrate = int(br)
 		samplerate = sr
 		channels = ch
 	} else {
-		bitrate = config.Cfg.StreamBitrate / 1000
-		samplerate = config.Cfg.StreamSamplerate
-		channels = config.Cfg.StreamChannels
+		bitrate = cfg.StreamBitrate / 1000
+		samplerate = cfg.StreamSamplerate
+		channels = cfg.StreamChannels
 	}
 
-	contenttype := ""
-	if config.Cfg.StreamFormat == "mpeg" {
-		contenttype = "audio/mpeg"
-	} else {
-		contenttype = "audio/aacp"
+	contenttype := contentType(cfg.StreamFormat)
+
+	if srv.ServerType == "shoutcast2" {
+		uc, err := uvoxHandshake(srv, cfg, sock, contenttype, bitrate)
+		if err != nil {
+			Close(sock)
+			return nil, err
+		}
+		logger.Log("["+srv.Name+"] Server connect successful", logger.LOG_INFO)
+		return uc, nil
 	}
 
-	if config.Cfg.ServerType == "shoutcast" {
-		if err := Send(sock, []byte(config.Cfg.Password+"\r\n")); err != nil {
+	if srv.ServerType == "shoutcast" {
+		if err := Send(sock, []byte(srv.Password+"\r\n")); err != nil {
 			logger.Log("Error sending password", logger.LOG_ERROR)
-			Connected = false
-			return sock, err
+			Close(sock)
+			return nil, err
 		}
 
 		time.Sleep(time.Second)
@@ -108,32 +291,44 @@ func ConnectServer(host string, port int, br float64, sr, ch int) (net.Conn, err
 		resp, err := Recv(sock)
 		if err != nil {
 			logger.Log("Error receiving ShoutCast response", logger.LOG_ERROR)
-			Connected = false
-			return sock, err
+			Close(sock)
+			return nil, err
 		}
 		//fmt.Println(string(resp[0:3]))
-		if string(resp[0:3]) != "OK2" {
-			logger.Log("Shoutcast password rejected: "+string(resp), logger.LOG_ERROR)
-			Connected = false
-			return sock, err
+		if !strings.HasPrefix(string(resp), "OK2") {
+			Close(sock)
+			return nil, &ServerError{Code: 401, Msg: "Shoutcast password rejected: " + string(resp)}
 		}
 		//fmt.Println("password accepted")
 		headers = "content-type:" + contenttype + "\r\n" +
-			"icy-name:" + config.Cfg.StreamName + "\r\n" +
-			"icy-genre:" + config.Cfg.StreamGenre + "\r\n" +
-			"icy-url:" + config.Cfg.StreamURL + "\r\n" +
-			"icy-pub:0\r\n" +
+			"icy-name:" + cfg.StreamName + "\r\n" +
+			"icy-genre:" + cfg.StreamGenre + "\r\n" +
+			"icy-url:" + cfg.StreamURL + "\r\n" +
+			"icy-pub:" + public(cfg) + "\r\n" +
 			fmt.Sprintf("icy-br:%d\r\n\r\n", bitrate)
 	} else {
-		headers = "SOURCE /" + config.Cfg.Mount + " HTTP/1.0\r\n" +
-			"Content-Type: " + contenttype + "\r\n" +
-			"Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("source:"+config.Cfg.Password)) + "\r\n" +
+		method := "SOURCE"
+		proto := "HTTP/1.0"
+		if srv.Protocol == "put" {
+			method = "PUT"
+			proto = "HTTP/1.1"
+		}
+		headers = method + " /" + srv.Mount + " " + proto + "\r\n"
+		if srv.Protocol == "put" {
+			headers += "Host: " + srv.Host + ":" + strconv.Itoa(port) + "\r\n" +
+				"Expect: 100-continue\r\n"
+			if srv.Chunked {
+				headers += "Transfer-Encoding: chunked\r\n"
+			}
+		}
+		headers += "Content-Type: " + contenttype + "\r\n" +
+			"Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("source:"+srv.Password)) + "\r\n" +
 			"User-Agent: goicy/" + config.Version + "\r\n" +
-			"ice-name: " + config.Cfg.StreamName + "\r\n" +
-			"ice-public: 0\r\n" +
-			"ice-url: " + config.Cfg.StreamURL + "\r\n" +
-			"ice-genre: " + config.Cfg.StreamGenre + "\r\n" +
-			"ice-description: " + config.Cfg.StreamDescription + "\r\n" +
+			"ice-name: " + cfg.StreamName + "\r\n" +
+			"ice-public: " + public(cfg) + "\r\n" +
+			"ice-url: " + cfg.StreamURL + "\r\n" +
+			"ice-genre: " + cfg.StreamGenre + "\r\n" +
+			"ice-description: " + cfg.StreamDescription + "\r\n" +
 			"ice-audio-info: bitrate=" + strconv.Itoa(bitrate) +
 			";channels=" + strconv.Itoa(channels) +
 			";samplerate=" + strconv.Itoa(samplerate) + "\r\n" +
@@ -142,26 +337,28 @@ func ConnectServer(host string, port int, br float64, sr, ch int) (net.Conn, err
 
 	if err := Send(sock, []byte(headers)); err != nil {
 		logger.Log("Error sending headers", logger.LOG_ERROR)
-		Connected = false
-		return sock, err
+		Close(sock)
+		return nil, err
 	}
 
-	if config.Cfg.ServerType == "icecast" {
-		time.Sleep(time.Second)
-		resp, err := Recv(sock)
+	if srv.ServerType == "icecast" {
+		resp, err := readResponse(sock)
 		if err != nil {
-			Connected = false
-			return sock, err
+			logger.Log("Error receiving Icecast response", logger.LOG_ERROR)
+			Close(sock)
+			return nil, err
+		}
+		logger.Log("["+srv.Name+"] Server response: "+resp.Proto+" "+strconv.Itoa(resp.Code)+" "+resp.Reason, logger.LOG_DEBUG)
+		if err := checkResponse(resp); err != nil {
+			Close(sock)
+			return nil, err
 		}
-		if string(resp[9:12]) != "200" {
-			Connected = false
-			return sock, errors.New("Invalid Icecast response: " + string(resp))
+		if srv.Protocol == "put" && srv.Chunked {
+			sock = &chunkedConn{sock}
 		}
 	}
 
-	logger.Log("Server connect successful", logger.LOG_INFO)
-	Connected = true
-	csock = sock
+	logger.Log("["+srv.Name+"] Server connect successful", logger.LOG_INFO)
 
 	return sock, nil
 }
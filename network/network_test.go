@@ -0,0 +1,80 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		raw     string
+		code    int
+		reason  string
+		headers map[string]string
+		err     bool
+	}{
+		{"HTTP/1.0 200 OK\r\n\r\n", 200, "OK", nil, false},
+		{"HTTP/1.1 100 Continue\r\n\r\n", 100, "Continue", nil, false},
+		{"HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"Icecast\"\r\nServer: Icecast 2.4.4\r\n\r\n",
+			401, "Unauthorized", map[string]string{"www-authenticate": "Basic realm=\"Icecast\"", "server": "Icecast 2.4.4"}, false},
+		{"HTTP/1.0 403 Mountpoint in use\n\n", 403, "Mountpoint in use", nil, false},
+		{"HTTP/1.0 200\r\n\r\n", 200, "", nil, false},
+		{"ICY 200 OK\r\n\r\n", 0, "", nil, true},
+		{"HTTP/1.0 abc OK\r\n\r\n", 0, "", nil, true},
+		{"OK2\r\n", 0, "", nil, true},
+		{"", 0, "", nil, true},
+	}
+	for _, tt := range tests {
+		resp, err := parseResponse(tt.raw)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseResponse(%q) didn't fail", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseResponse(%q) failed: %v", tt.raw, err)
+			continue
+		}
+		if resp.Code != tt.code || resp.Reason != tt.reason {
+			t.Errorf("parseResponse(%q) = %d %q, want %d %q", tt.raw, resp.Code, resp.Reason, tt.code, tt.reason)
+		}
+		for k, v := range tt.headers {
+			if resp.Headers[k] != v {
+				t.Errorf("parseResponse(%q) header %s = %q, want %q", tt.raw, k, resp.Headers[k], v)
+			}
+		}
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		code   int
+		reason string
+		want   int // code of the ServerError, 0 for no error
+	}{
+		{100, "Continue", 0},
+		{200, "OK", 0},
+		{401, "Unauthorized", 401},
+		{403, "Forbidden", 403},
+		{403, "Mountpoint in use", 409},
+		{409, "Conflict", 409},
+		{500, "Internal Server Error", 500},
+	}
+	for _, tt := range tests {
+		err := checkResponse(&response{Code: tt.code, Reason: tt.reason})
+		if tt.want == 0 {
+			if err != nil {
+				t.Errorf("checkResponse(%d %s) = %v, want nil", tt.code, tt.reason, err)
+			}
+			continue
+		}
+		se, ok := err.(*ServerError)
+		if !ok {
+			t.Errorf("checkResponse(%d %s) = %v, want a ServerError", tt.code, tt.reason, err)
+			continue
+		}
+		if se.Code != tt.want {
+			t.Errorf("checkResponse(%d %s) code = %d, want %d", tt.code, tt.reason, se.Code, tt.want)
+		}
+	}
+}
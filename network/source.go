@@ -0,0 +1,236 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/stunndard/goicy/config"
+	"github.com/stunndard/goicy/logger"
+)
+
+// how many writes (~1 sec of audio each) are queued for a slow server
+const queueLength = 16
+
+// how long to wait before reconnecting a failed source
+const retryDelay = 10 * time.Second
+
+// errRetryLater is returned by Connect before the retry time of a failed source
+var errRetryLater = errors.New("Waiting to reconnect")
+
+// IsRetryLater reports whether Connect didn't try as the source failed recently
+func IsRetryLater(err error) bool {
+	return err == errRetryLater
+}
+
+// Source is a source client connection to a single server.
+// It carries its own settings and state, so any number of
+// sources can be streamed to from one process.
+// Writes are queued and sent in background, so a slow or
+// failing server never blocks the caller. A failed source
+// reconnects by itself on the next writes.
+type Source struct {
+	Server config.Server
+	Config *config.Config
+
+	mu      sync.Mutex
+	conn    *sourceConn
+	retryAt time.Time
+	br      float64
+	sr, ch  int
+
+	// metadata update waiting to be sent
+	mdMu      sync.Mutex
+	mdNext    string
+	mdQueued  bool
+	mdRunning bool
+}
+
+// sourceConn is the connection to the server, the writes are queued
+// while it's connecting and sent once it's connected
+type sourceConn struct {
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+
+	mu   sync.Mutex
+	sock net.Conn // nil until connected
+}
+
+// sets the connected socket, false if the connection was closed meanwhile
+func (c *sourceConn) connected(sock net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	c.sock = sock
+	return true
+}
+
+func (c *sourceConn) socket() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sock
+}
+
+func (c *sourceConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		if c.sock != nil {
+			Close(c.sock)
+		}
+		c.mu.Unlock()
+	})
+}
+
+// NewSource creates a source for the server, cfg holds the stream settings
+func NewSource(srv config.Server, cfg *config.Config) *Source {
+	return &Source{Server: srv, Config: cfg}
+}
+
+func (s *Source) Name() string {
+	return s.Server.Name
+}
+
+func (s *Source) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
+// Connect connects and logs in to the server if not connected or
+// connecting yet. The writes made while it's connecting are sent once
+// it's connected, so the server gets the stream from the first write.
+// A failed source isn't connected again before its retry time.
+// br, sr and ch are the stream bitrate, samplerate and channels,
+// they are only used in file mode.
+func (s *Source) Connect(br float64, sr, ch int) error {
+	s.mu.Lock()
+	s.br, s.sr, s.ch = br, sr, ch
+	if s.conn != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	if time.Now().Before(s.retryAt) {
+		s.mu.Unlock()
+		return errRetryLater
+	}
+	c := &sourceConn{
+		queue: make(chan []byte, queueLength),
+		done:  make(chan struct{}),
+	}
+	s.conn = c
+	s.mu.Unlock()
+
+	sock, err := connectServer(&s.Server, s.Config, br, sr, ch)
+	if err != nil {
+		s.drop(c)
+		return err
+	}
+	if !c.connected(sock) {
+		Close(sock)
+		return errors.New("Disconnected while connecting")
+	}
+	go s.writer(c)
+	return nil
+}
+
+// reconnects in background with the last known stream parameters
+func (s *Source) reconnect() {
+	s.mu.Lock()
+	if s.conn != nil || time.Now().Before(s.retryAt) {
+		s.mu.Unlock()
+		return
+	}
+	br, sr, ch := s.br, s.sr, s.ch
+	s.mu.Unlock()
+
+	go func() {
+		logger.Log("["+s.Name()+"] Reconnecting...", logger.LOG_INFO)
+		if err := s.Connect(br, sr, ch); err != nil {
+			logger.Log("["+s.Name()+"] Cannot connect to server: "+err.Error(), logger.LOG_ERROR)
+		}
+	}()
+}
+
+// Write queues buf to be sent to the server without blocking.
+// The data is dropped if the server can't keep up.
+func (s *Source) Write(buf []byte) (int, error) {
+	s.mu.Lock()
+	c := s.conn
+	s.mu.Unlock()
+	if c == nil {
+		// an Ogg stream is joined at the next track, where its headers are
+		if !s.isOgg() {
+			s.reconnect()
+		}
+		return 0, errors.New("Not connected to server")
+	}
+	select {
+	case c.queue <- buf:
+	case <-c.done:
+		return 0, errors.New("Not connected to server")
+	default:
+		if s.isOgg() {
+			// the listeners can't decode the pages after the gap,
+			// the stream starts over with the headers of the next track
+			logger.Log("["+s.Name()+"] Send queue full, disconnecting until the next track", logger.LOG_ERROR)
+			s.drop(c)
+			return 0, errors.New("Send queue full")
+		}
+		logger.Log("["+s.Name()+"] Send queue full, dropping data", logger.LOG_ERROR)
+	}
+	return len(buf), nil
+}
+
+// whether the stream is made of Ogg pages
+func (s *Source) isOgg() bool {
+	switch s.Config.StreamFormat {
+	case "ogg", "vorbis", "opus", "flac":
+		return true
+	}
+	return false
+}
+
+// closes the failed connection, it's reconnected later
+func (s *Source) drop(c *sourceConn) {
+	s.mu.Lock()
+	if s.conn == c {
+		s.conn = nil
+		s.retryAt = time.Now().Add(retryDelay)
+	}
+	s.mu.Unlock()
+	c.close()
+}
+
+func (s *Source) writer(c *sourceConn) {
+	for {
+		select {
+		case buf := <-c.queue:
+			if err := Send(c.socket(), buf); err != nil {
+				logger.Log("["+s.Name()+"] Error sending data stream: "+err.Error(), logger.LOG_ERROR)
+				s.drop(c)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close disconnects from the server, queued data is dropped
+func (s *Source) Close() error {
+	s.mu.Lock()
+	c := s.conn
+	s.conn = nil
+	s.mu.Unlock()
+	if c != nil {
+		c.close()
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stunndard/goicy/config"
+)
+
+// accepts one source connection like icecast and returns the stream sent to it
+func icecastServer(t *testing.T, l net.Listener, got chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		got <- ""
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			got <- ""
+			return
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	conn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+	data, _ := ioutil.ReadAll(r)
+	got <- string(data)
+}
+
+func TestSourceQueuesWhileConnecting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan string, 1)
+	go icecastServer(t, l, got)
+
+	port := l.Addr().(*net.TCPAddr).Port
+	src := NewSource(config.Server{ServerType: "icecast", Host: "127.0.0.1", Port: port, Mount: "live"},
+		&config.Config{StreamFormat: "mpeg"})
+	connected := make(chan error, 1)
+	go func() {
+		connected <- src.Connect(0, 0, 0)
+	}()
+	for !src.Connected() {
+		time.Sleep(time.Millisecond)
+	}
+	// written while the source is connecting
+	if _, err := src.Write([]byte("first ")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	src.Close()
+
+	if data := <-got; data != "first second" {
+		t.Errorf("server got %q, want %q", data, "first second")
+	}
+}
+
+func TestSourceRetryLater(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	src := NewSource(config.Server{ServerType: "icecast", Host: "127.0.0.1", Port: port, Mount: "live"},
+		&config.Config{StreamFormat: "mpeg"})
+	if err := src.Connect(0, 0, 0); err == nil || IsRetryLater(err) {
+		t.Fatalf("Connect() to a closed port = %v, want a connection error", err)
+	}
+	if src.Connected() {
+		t.Error("Connected() after a failed Connect()")
+	}
+	// the failed server isn't dialed again at once
+	if err := src.Connect(0, 0, 0); !IsRetryLater(err) {
+		t.Errorf("Connect() again = %v, want %v", err, errRetryLater)
+	}
+	if _, err := src.Write([]byte("data")); err == nil {
+		t.Error("Write() to a failed source didn't fail")
+	}
+}
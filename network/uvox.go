@@ -0,0 +1,254 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/stunndard/goicy/config"
+	"github.com/stunndard/goicy/logger"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Ultravox 2.1 message types used by SHOUTcast v2 (DNAS 2.x) sources
+const (
+	uvoxMsgAuth        = 0x1001
+	uvoxMsgSetup       = 0x1002
+	uvoxMsgBufferSize  = 0x1003
+	uvoxMsgStandby     = 0x1004
+	uvoxMsgTerminate   = 0x1005
+	uvoxMsgMaxPayload  = 0x1008
+	uvoxMsgCipher      = 0x1009
+	uvoxMsgMimeType    = 0x1040
+	uvoxMsgIcyName     = 0x1100
+	uvoxMsgIcyGenre    = 0x1101
+	uvoxMsgIcyURL      = 0x1102
+	uvoxMsgIcyPub      = 0x1103
+	uvoxMsgMetadataXML = 0x3902 // class 3, cacheable metadata
+	uvoxMsgDataMPEG    = 0x7000
+	uvoxMsgDataAACLC   = 0x8001
+	uvoxMsgDataAACP    = 0x8003
+)
+
+const uvoxMaxPayload = 16377
+
+// max length of the song title in the metadata message
+const uvoxMaxTitle = 1024
+
+// buffer size asked from the server, in kilobytes
+const uvoxBufferSize = 64
+
+// uvoxConn wraps everything written to it into Ultravox data messages.
+// The data and the metadata are written from different goroutines, the
+// messages are written whole one at a time.
+type uvoxConn struct {
+	net.Conn
+	msgType uint16
+	mu      sync.Mutex
+}
+
+// writes a single message
+func (c *uvoxConn) send(msgType uint16, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Send(c.Conn, uvoxMessage(msgType, payload))
+}
+
+func (c *uvoxConn) Write(b []byte) (int, error) {
+	sent := 0
+	for sent < len(b) {
+		n := len(b) - sent
+		if n > uvoxMaxPayload {
+			n = uvoxMaxPayload
+		}
+		if err := c.send(c.msgType, b[sent:sent+n]); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+func (c *uvoxConn) Close() error {
+	// a write stuck on a dead server doesn't hold the close
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.send(uvoxMsgTerminate, nil)
+	return c.Conn.Close()
+}
+
+// returns the data message type of the stream format, Ultravox
+// doesn't carry Ogg streams
+func uvoxDataType(cfg *config.Config) (uint16, error) {
+	switch cfg.StreamFormat {
+	case "mpeg":
+		return uvoxMsgDataMPEG, nil
+	case "aac":
+		// the profile is known only when ffmpeg encodes the stream
+		if cfg.StreamType != "file" && cfg.StreamReencode && cfg.StreamAACProfile == "lc" {
+			return uvoxMsgDataAACLC, nil
+		}
+		return uvoxMsgDataAACP, nil
+	}
+	return 0, errors.New("Stream format " + cfg.StreamFormat + " is not supported by Shoutcast v2 servers")
+}
+
+// builds an Ultravox message:
+// sync(0x5A) qos(0x00) type(2) length(2) payload 0x00
+func uvoxMessage(msgType uint16, payload []byte) []byte {
+	msg := make([]byte, 6, len(payload)+7)
+	msg[0] = 0x5A
+	msg[1] = 0x00
+	binary.BigEndian.PutUint16(msg[2:4], msgType)
+	binary.BigEndian.PutUint16(msg[4:6], uint16(len(payload)))
+	msg = append(msg, payload...)
+	return append(msg, 0x00)
+}
+
+func uvoxRecv(sock net.Conn) (uint16, string, error) {
+	sock.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer sock.SetReadDeadline(time.Time{})
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(sock, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != 0x5A {
+		return 0, "", errors.New("Invalid Ultravox response")
+	}
+	msgType := binary.BigEndian.Uint16(header[2:4])
+	payload := make([]byte, int(binary.BigEndian.Uint16(header[4:6]))+1)
+	if _, err := io.ReadFull(sock, payload); err != nil {
+		return 0, "", err
+	}
+	return msgType, string(payload[:len(payload)-1]), nil
+}
+
+// sends a request message and checks the server acknowledged it
+func uvoxRequest(sock net.Conn, msgType uint16, payload string) (string, error) {
+	if err := Send(sock, uvoxMessage(msgType, []byte(payload))); err != nil {
+		return "", err
+	}
+	respType, resp, err := uvoxRecv(sock)
+	if err != nil {
+		return "", err
+	}
+	if respType != msgType {
+		return "", errors.New("Unexpected Ultravox response type: " + fmt.Sprintf("0x%04X", respType))
+	}
+	if !strings.HasPrefix(resp, "ACK") {
+		return "", &ServerError{Code: int(msgType), Msg: "Shoutcast v2 request rejected: " + resp}
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(resp, "ACK"), ":"), nil
+}
+
+// XTEA enciphering as used by the Ultravox authentication
+func xteaEncipher(v0, v1 uint32, k [4]uint32) (uint32, uint32) {
+	var sum uint32
+	const delta = 0x9E3779B9
+	for i := 0; i < 32; i++ {
+		v0 += (((v1 << 4) ^ (v1 >> 5)) + v1) ^ (sum + k[sum&3])
+		sum += delta
+		v1 += (((v0 << 4) ^ (v0 >> 5)) + v0) ^ (sum + k[(sum>>11)&3])
+	}
+	return v0, v1
+}
+
+// encrypts s with the cipher key received from the server
+// and returns it hex encoded
+func uvoxEncrypt(s, key string) string {
+	kbuf := make([]byte, 16)
+	copy(kbuf, key)
+	var k [4]uint32
+	for i := range k {
+		k[i] = binary.BigEndian.Uint32(kbuf[i*4:])
+	}
+
+	data := []byte(s)
+	if len(data)%8 != 0 || len(data) == 0 {
+		data = append(data, make([]byte, 8-len(data)%8)...)
+	}
+
+	res := ""
+	for i := 0; i < len(data); i += 8 {
+		v0, v1 := xteaEncipher(binary.BigEndian.Uint32(data[i:]), binary.BigEndian.Uint32(data[i+4:]), k)
+		res += fmt.Sprintf("%08x%08x", v0, v1)
+	}
+	return res
+}
+
+// performs the Ultravox 2.1 source handshake and switches
+// the connection to data transfer mode
+func uvoxHandshake(srv *config.Server, cfg *config.Config, sock net.Conn, contenttype string, bitrate int) (*uvoxConn, error) {
+	msgType, err := uvoxDataType(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := uvoxRequest(sock, uvoxMsgCipher, "2.1")
+	if err != nil {
+		logger.Log("Error requesting Shoutcast v2 cipher key", logger.LOG_ERROR)
+		return nil, err
+	}
+
+	sid := srv.StreamID
+	if sid < 1 {
+		sid = 1
+	}
+	auth := "2.1:" + strconv.Itoa(sid) + ":" +
+		uvoxEncrypt(srv.User, key) + ":" +
+		uvoxEncrypt(srv.Password, key)
+	if _, err := uvoxRequest(sock, uvoxMsgAuth, auth); err != nil {
+		logger.Log("Shoutcast v2 authentication failed", logger.LOG_ERROR)
+		return nil, err
+	}
+
+	requests := []struct {
+		msgType uint16
+		payload string
+	}{
+		{uvoxMsgMimeType, contenttype},
+		{uvoxMsgSetup, strconv.Itoa(bitrate*1000) + ":" + strconv.Itoa(bitrate*1000)},
+		{uvoxMsgBufferSize, strconv.Itoa(uvoxBufferSize) + ":0"},
+		{uvoxMsgMaxPayload, strconv.Itoa(uvoxMaxPayload) + ":0"},
+		{uvoxMsgIcyName, cfg.StreamName},
+		{uvoxMsgIcyGenre, cfg.StreamGenre},
+		{uvoxMsgIcyURL, cfg.StreamURL},
+		{uvoxMsgIcyPub, public(cfg)},
+		{uvoxMsgStandby, "0"},
+	}
+	for _, r := range requests {
+		if _, err := uvoxRequest(sock, r.msgType, r.payload); err != nil {
+			logger.Log("Shoutcast v2 stream setup failed", logger.LOG_ERROR)
+			return nil, err
+		}
+	}
+
+	return &uvoxConn{Conn: sock, msgType: msgType}, nil
+}
+
+// sends the song title in-band as Ultravox XML metadata
+func sendUvoxMetadata(uc *uvoxConn, metadata string) error {
+	if len(metadata) > uvoxMaxTitle {
+		// not in the middle of a character
+		n := uvoxMaxTitle
+		for n > 0 && !utf8.RuneStart(metadata[n]) {
+			n--
+		}
+		metadata = metadata[:n]
+	}
+	var title strings.Builder
+	xml.EscapeText(&title, []byte(metadata))
+	body := "<?xml version=\"1.0\" encoding=\"UTF-8\" ?><metadata><TIT2>" +
+		title.String() + "</TIT2></metadata>"
+
+	// metadata id, span and index of this single part message
+	payload := []byte{0x00, 0x01, 0x00, 0x01, 0x00, 0x01}
+	payload = append(payload, body...)
+	return uc.send(uvoxMsgMetadataXML, payload)
+}
@@ -0,0 +1,218 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stunndard/goicy/config"
+)
+
+func TestUvoxMessage(t *testing.T) {
+	tests := []struct {
+		msgType uint16
+		payload string
+		want    []byte
+	}{
+		{uvoxMsgStandby, "0", []byte{0x5A, 0x00, 0x10, 0x04, 0x00, 0x01, '0', 0x00}},
+		{uvoxMsgTerminate, "", []byte{0x5A, 0x00, 0x10, 0x05, 0x00, 0x00, 0x00}},
+		{uvoxMsgDataMPEG, "ab", []byte{0x5A, 0x00, 0x70, 0x00, 0x00, 0x02, 'a', 'b', 0x00}},
+	}
+	for _, tt := range tests {
+		if got := uvoxMessage(tt.msgType, []byte(tt.payload)); !bytes.Equal(got, tt.want) {
+			t.Errorf("uvoxMessage(0x%04X, %q) = % x, want % x", tt.msgType, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestXteaEncipher(t *testing.T) {
+	// test vectors of the reference implementation, 32 rounds
+	tests := []struct {
+		v0, v1 uint32
+		k      [4]uint32
+		w0, w1 uint32
+	}{
+		{0x41424344, 0x45464748, [4]uint32{0x00010203, 0x04050607, 0x08090A0B, 0x0C0D0E0F}, 0x497DF3D0, 0x72612CB5},
+		{0x41414141, 0x41414141, [4]uint32{0x00010203, 0x04050607, 0x08090A0B, 0x0C0D0E0F}, 0xE78F2D13, 0x744341D8},
+		{0x5A5B6E27, 0x8948D77F, [4]uint32{0x00010203, 0x04050607, 0x08090A0B, 0x0C0D0E0F}, 0x41414141, 0x41414141},
+		{0x41424344, 0x45464748, [4]uint32{}, 0xA0390589, 0xF8B8EFA5},
+	}
+	for _, tt := range tests {
+		w0, w1 := xteaEncipher(tt.v0, tt.v1, tt.k)
+		if w0 != tt.w0 || w1 != tt.w1 {
+			t.Errorf("xteaEncipher(%08x, %08x) = %08x %08x, want %08x %08x", tt.v0, tt.v1, w0, w1, tt.w0, tt.w1)
+		}
+	}
+}
+
+func TestUvoxEncrypt(t *testing.T) {
+	tests := []struct {
+		s, key string
+		want   int // length of the hex result
+	}{
+		{"", "key", 16},
+		{"user", "key", 16},
+		{"password", "key", 16},
+		{"password1", "key", 32},
+	}
+	for _, tt := range tests {
+		got := uvoxEncrypt(tt.s, tt.key)
+		if len(got) != tt.want {
+			t.Errorf("uvoxEncrypt(%q) = %q, want %d hex digits", tt.s, got, tt.want)
+		}
+	}
+	if uvoxEncrypt("password", "key1") == uvoxEncrypt("password", "key2") {
+		t.Error("uvoxEncrypt doesn't depend on the key")
+	}
+}
+
+type uvoxMsg struct {
+	msgType uint16
+	payload string
+}
+
+// acknowledges every message of the handshake like a DNAS server
+func uvoxServer(t *testing.T, conn net.Conn, got chan<- []uvoxMsg) {
+	var msgs []uvoxMsg
+	defer func() { got <- msgs }()
+	for {
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if header[0] != 0x5A || header[1] != 0x00 {
+			t.Errorf("bad message header % x", header)
+			return
+		}
+		msgType := binary.BigEndian.Uint16(header[2:4])
+		payload := make([]byte, int(binary.BigEndian.Uint16(header[4:6]))+1)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		if payload[len(payload)-1] != 0x00 {
+			t.Errorf("message 0x%04X doesn't end with 0x00", msgType)
+		}
+		msgs = append(msgs, uvoxMsg{msgType, string(payload[:len(payload)-1])})
+
+		ack := "ACK"
+		if msgType == uvoxMsgCipher {
+			ack = "ACK:secret"
+		}
+		conn.Write(uvoxMessage(msgType, []byte(ack)))
+		if msgType == uvoxMsgStandby {
+			return
+		}
+	}
+}
+
+func TestUvoxHandshake(t *testing.T) {
+	srv := &config.Server{User: "source", Password: "pass", StreamID: 2}
+	cfg := &config.Config{
+		StreamName:   "name",
+		StreamGenre:  "genre",
+		StreamURL:    "http://example.com",
+		StreamPublic: true,
+		StreamFormat: "mpeg",
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	got := make(chan []uvoxMsg, 1)
+	go uvoxServer(t, server, got)
+
+	uc, err := uvoxHandshake(srv, cfg, client, "audio/mpeg", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uc.msgType != uvoxMsgDataMPEG {
+		t.Errorf("data message type = 0x%04X, want 0x%04X", uc.msgType, uvoxMsgDataMPEG)
+	}
+
+	want := []uvoxMsg{
+		{0x1009, "2.1"},
+		{0x1001, "2.1:2:" + uvoxEncrypt("source", "secret") + ":" + uvoxEncrypt("pass", "secret")},
+		{0x1040, "audio/mpeg"},
+		{0x1002, "128000:128000"},
+		{0x1003, "64:0"},
+		{0x1008, "16377:0"},
+		{0x1100, "name"},
+		{0x1101, "genre"},
+		{0x1102, "http://example.com"},
+		{0x1103, "1"},
+		{0x1004, "0"},
+	}
+	msgs := <-got
+	if len(msgs) != len(want) {
+		t.Fatalf("got %d handshake messages, want %d: %v", len(msgs), len(want), msgs)
+	}
+	for i := range want {
+		if msgs[i] != want[i] {
+			t.Errorf("message %d = 0x%04X %q, want 0x%04X %q", i, msgs[i].msgType, msgs[i].payload, want[i].msgType, want[i].payload)
+		}
+	}
+}
+
+func TestUvoxDataType(t *testing.T) {
+	tests := []struct {
+		cfg  config.Config
+		want uint16 // 0 if the format is refused
+	}{
+		{config.Config{StreamFormat: "mpeg"}, uvoxMsgDataMPEG},
+		{config.Config{StreamFormat: "aac", StreamType: "file"}, uvoxMsgDataAACP},
+		{config.Config{StreamFormat: "aac", StreamType: "file", StreamAACProfile: "lc"}, uvoxMsgDataAACP},
+		{config.Config{StreamFormat: "aac", StreamType: "ffmpeg", StreamReencode: true, StreamAACProfile: "lc"}, uvoxMsgDataAACLC},
+		{config.Config{StreamFormat: "aac", StreamType: "ffmpeg", StreamReencode: true, StreamAACProfile: "he"}, uvoxMsgDataAACP},
+		{config.Config{StreamFormat: "ogg"}, 0},
+		{config.Config{StreamFormat: "opus"}, 0},
+		{config.Config{StreamFormat: "flac"}, 0},
+	}
+	for _, tt := range tests {
+		got, err := uvoxDataType(&tt.cfg)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("uvoxDataType(%+v) = 0x%04X, want error", tt.cfg, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("uvoxDataType(%+v) = 0x%04X, %v, want 0x%04X", tt.cfg, got, err, tt.want)
+		}
+	}
+}
+
+func TestSendUvoxMetadata(t *testing.T) {
+	tests := []struct {
+		title, want string
+	}{
+		{"Artist - Title & <Co>", "Artist - Title &amp; &lt;Co&gt;"},
+		{strings.Repeat("a", 1030), strings.Repeat("a", 1024)},
+		// the 2 byte é would be cut at 1024
+		{strings.Repeat("a", 1023) + "ébc", strings.Repeat("a", 1023)},
+		{strings.Repeat("a", 1022) + "ébc", strings.Repeat("a", 1022) + "é"},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		uc := &uvoxConn{Conn: client, msgType: uvoxMsgDataMPEG}
+		go func() {
+			sendUvoxMetadata(uc, tt.title)
+			client.Close()
+		}()
+		msg, _ := ioutil.ReadAll(server)
+		server.Close()
+
+		if len(msg) < 13 || binary.BigEndian.Uint16(msg[2:4]) != uvoxMsgMetadataXML {
+			t.Errorf("sendUvoxMetadata(%q) sent % x", tt.title, msg)
+			continue
+		}
+		body := string(msg[12 : len(msg)-1])
+		title := body[strings.Index(body, "<TIT2>")+6 : strings.Index(body, "</TIT2>")]
+		if title != tt.want || !utf8.ValidString(body) {
+			t.Errorf("sendUvoxMetadata(%q) title = %q, want %q", tt.title, title, tt.want)
+		}
+	}
+}
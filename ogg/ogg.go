@@ -0,0 +1,432 @@
+package ogg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/util"
+)
+
+// page header types
+const (
+	HeaderContinued = 0x01
+	HeaderBOS       = 0x02
+	HeaderEOS       = 0x04
+)
+
+// granule position of pages on which no packet ends
+const noGranule = -1
+
+var crcTable [256]uint32
+
+func init() {
+	// ogg uses the non-reflected crc32 with 0x04C11DB7 polynomial
+	for i := range crcTable {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		crcTable[i] = r
+	}
+}
+
+func crc(b []byte) uint32 {
+	var c uint32
+	for _, v := range b {
+		c = (c << 8) ^ crcTable[byte(c>>24)^v]
+	}
+	return c
+}
+
+// Page is a single Ogg page
+type Page struct {
+	HeaderType byte
+	Granule    int64
+	Serial     uint32
+	Sequence   uint32
+	Segments   []byte // lacing values
+	Body       []byte
+}
+
+// Bytes returns the page ready to be sent, with the checksum recalculated
+func (p *Page) Bytes() []byte {
+	buf := make([]byte, 27, 27+len(p.Segments)+len(p.Body))
+	copy(buf, "OggS")
+	buf[4] = 0
+	buf[5] = p.HeaderType
+	binary.LittleEndian.PutUint64(buf[6:], uint64(p.Granule))
+	binary.LittleEndian.PutUint32(buf[14:], p.Serial)
+	binary.LittleEndian.PutUint32(buf[18:], p.Sequence)
+	buf[26] = byte(len(p.Segments))
+	buf = append(buf, p.Segments...)
+	buf = append(buf, p.Body...)
+	binary.LittleEndian.PutUint32(buf[22:], crc(buf))
+	return buf
+}
+
+// ReadPage reads the next page, skipping garbage before it
+func ReadPage(r *bufio.Reader) (*Page, error) {
+	// find capture pattern
+	skipped := 0
+	for {
+		b, err := r.Peek(4)
+		if err != nil {
+			if err == io.EOF && len(b) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if string(b) == "OggS" {
+			break
+		}
+		r.Discard(1)
+		skipped++
+	}
+	if skipped > 0 {
+		logger.Log("Skipped "+strconv.Itoa(skipped)+" bytes of garbage before Ogg page", logger.LOG_DEBUG)
+	}
+
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[4] != 0 {
+		return nil, errors.New("Unsupported Ogg version " + strconv.Itoa(int(header[4])))
+	}
+	p := &Page{
+		HeaderType: header[5],
+		Granule:    int64(binary.LittleEndian.Uint64(header[6:])),
+		Serial:     binary.LittleEndian.Uint32(header[14:]),
+		Sequence:   binary.LittleEndian.Uint32(header[18:]),
+		Segments:   make([]byte, header[26]),
+	}
+	if _, err := io.ReadFull(r, p.Segments); err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, l := range p.Segments {
+		size += int(l)
+	}
+	p.Body = make([]byte, size)
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Packets splits a page body into packets. The last one is
+// incomplete if it continues on the next page.
+func Packets(segments, body []byte) [][]byte {
+	var packets [][]byte
+	start, pos := 0, 0
+	for i, l := range segments {
+		pos += int(l)
+		if l < 255 || i == len(segments)-1 {
+			packets = append(packets, body[start:pos])
+			start = pos
+		}
+	}
+	return packets
+}
+
+// Lacing returns the segment table of a single packet of n bytes
+func Lacing(n int) []byte {
+	segments := bytes.Repeat([]byte{255}, n/255)
+	return append(segments, byte(n%255))
+}
+
+// Writer packs packets of a single logical stream into pages
+type Writer struct {
+	serial uint32
+	seq    uint32
+}
+
+// NewWriter starts a new logical stream with a random serial number
+func NewWriter() *Writer {
+	return &Writer{serial: rand.Uint32()}
+}
+
+// Packet returns the page(s) holding the packet, granule is the
+// position after it. Every packet starts a new page, the very
+// first one is marked as the beginning of the stream.
+func (w *Writer) Packet(packet []byte, granule int64) []byte {
+	var buf []byte
+	segments := Lacing(len(packet))
+	continued := false
+	for len(segments) > 0 {
+		n := len(segments)
+		if n > 255 {
+			n = 255
+		}
+		size := 0
+		for _, l := range segments[:n] {
+			size += int(l)
+		}
+		p := &Page{
+			Granule:  noGranule,
+			Serial:   w.serial,
+			Sequence: w.seq,
+			Segments: segments[:n],
+			Body:     packet[:size],
+		}
+		if w.seq == 0 {
+			p.HeaderType |= HeaderBOS
+		}
+		if continued {
+			p.HeaderType |= HeaderContinued
+		}
+		if n == len(segments) {
+			// the packet ends on this page
+			p.Granule = granule
+		}
+		buf = append(buf, p.Bytes()...)
+		w.seq++
+		segments = segments[n:]
+		packet = packet[size:]
+		continued = true
+	}
+	return buf
+}
+
+// End returns an empty page that ends the logical stream
+func (w *Writer) End(granule int64) []byte {
+	p := &Page{
+		HeaderType: HeaderEOS,
+		Granule:    granule,
+		Serial:     w.serial,
+		Sequence:   w.seq,
+	}
+	w.seq++
+	return p.Bytes()
+}
+
+type logical struct {
+	codec   string
+	rate    int
+	serial  uint32 // serial number sent to the server
+	granule int64  // last granule position seen
+	started bool   // an audio page was seen
+	seq     uint32 // sequence number of the last page
+	ended   bool   // the EOS page was seen
+}
+
+// Reader reads Ogg pages paced by granule position. Every logical
+// stream gets a new serial number, so consecutive tracks never share
+// one and the server sees valid chained Ogg.
+type Reader struct {
+	Codec      string
+	SampleRate int
+	Channels   int
+
+	r       *bufio.Reader
+	streams map[uint32]*logical
+	samples int64 // samples read so far, in SampleRate units
+	target  int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:       bufio.NewReaderSize(r, 65536),
+		streams: make(map[uint32]*logical),
+	}
+}
+
+// identifies the codec from the first packet of a logical stream
+func identify(packet []byte) (codec string, rate, channels int) {
+	switch {
+	case len(packet) >= 16 && packet[0] == 0x01 && string(packet[1:7]) == "vorbis":
+		return "vorbis", int(binary.LittleEndian.Uint32(packet[12:])), int(packet[11])
+	case len(packet) >= 19 && string(packet[0:8]) == "OpusHead":
+		// opus granule position is always in 48 kHz units
+		return "opus", 48000, int(packet[9])
+	case len(packet) >= 51 && packet[0] == 0x7F && string(packet[1:5]) == "FLAC":
+		// STREAMINFO follows the Ogg FLAC mapping header
+		si := packet[17:]
+		return "flac", int(si[10])<<12 | int(si[11])<<4 | int(si[12])>>4, int((si[12]>>1)&0x07) + 1
+	}
+	return "", 0, 0
+}
+
+// reads the next page and rewrites its serial number
+func (o *Reader) nextPage() (*Page, *logical, error) {
+	p, err := ReadPage(o.r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ls, ok := o.streams[p.Serial]
+	if !ok || p.HeaderType&HeaderBOS != 0 {
+		ls = &logical{serial: o.newSerial()}
+		if packets := Packets(p.Segments, p.Body); len(packets) > 0 {
+			ls.codec, ls.rate, _ = identify(packets[0])
+			if ls.codec != "" && o.Codec == "" {
+				o.Codec, o.SampleRate, o.Channels = identify(packets[0])
+			}
+		}
+		if p.HeaderType&HeaderBOS != 0 {
+			logger.Log("New Ogg logical stream: "+ls.codec, logger.LOG_DEBUG)
+		}
+		o.streams[p.Serial] = ls
+	}
+	p.Serial = ls.serial
+	ls.seq = p.Sequence
+	ls.ended = p.HeaderType&HeaderEOS != 0
+	return p, ls, nil
+}
+
+func (o *Reader) newSerial() uint32 {
+	for {
+		serial := rand.Uint32()
+		unique := true
+		for _, ls := range o.streams {
+			if ls.serial == serial {
+				unique = false
+			}
+		}
+		if unique {
+			return serial
+		}
+	}
+}
+
+// adds the duration of the page to the samples read
+func (o *Reader) account(p *Page, ls *logical) {
+	if ls.codec == "" || ls.rate == 0 || p.Granule == noGranule {
+		return
+	}
+	if !ls.started {
+		// the header pages are at 0
+		if p.Granule <= 0 {
+			return
+		}
+		ls.started = true
+		// a stream cut from the middle, like a live capture, doesn't
+		// start at 0, its first audio page is the baseline then
+		if p.Granule > int64(ls.rate) {
+			ls.granule = p.Granule
+			return
+		}
+	}
+	if p.Granule > ls.granule {
+		delta := p.Granule - ls.granule
+		if o.SampleRate > 0 && ls.rate != o.SampleRate {
+			delta = delta * int64(o.SampleRate) / int64(ls.rate)
+		}
+		o.samples += delta
+		ls.granule = p.Granule
+	}
+}
+
+// ReadSamples returns whole pages covering about n more samples.
+// The pace is kept by granule position, so the sum of the returned
+// audio follows the sum of n without drifting.
+func (o *Reader) ReadSamples(n int) ([]byte, error) {
+	var buf []byte
+	o.target += int64(n)
+	for o.samples < o.target {
+		p, ls, err := o.nextPage()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// the input file has ended
+				break
+			}
+			return buf, err
+		}
+		o.account(p, ls)
+		buf = append(buf, p.Bytes()...)
+	}
+	return buf, nil
+}
+
+// Finish returns the pages that end the logical streams not ended yet.
+// It's called when the track is stopped before the end of the file, so
+// the next one starts after complete streams.
+func (o *Reader) Finish() []byte {
+	var buf []byte
+	for _, ls := range o.streams {
+		if ls.ended {
+			continue
+		}
+		ls.ended = true
+		ls.seq++
+		p := &Page{
+			HeaderType: HeaderEOS,
+			Granule:    ls.granule,
+			Serial:     ls.serial,
+			Sequence:   ls.seq,
+		}
+		buf = append(buf, p.Bytes()...)
+	}
+	return buf
+}
+
+// gets information about Ogg file, frames are counted in samples
+// and spf is always 1
+func GetFileInfo(filename string, br *float64, spf, sr, frames, ch *int) error {
+
+	if ok := util.FileExists(filename); !ok {
+		err := new(util.FileError)
+		err.Msg = "File doesn't exist"
+		return err
+	}
+
+	// open file
+	f, err := os.Open(filename)
+	if err != nil {
+		err := new(util.FileError)
+		err.Msg = "Cannot open file"
+		return err
+	}
+
+	defer f.Close()
+
+	o := NewReader(f)
+	pages := 0
+	for {
+		p, ls, err := o.nextPage()
+		if err != nil {
+			break
+		}
+		o.account(p, ls)
+		pages++
+	}
+
+	if o.Codec == "" || o.SampleRate == 0 {
+		err := new(util.FileError)
+		err.Msg = "Couldn't find Ogg Vorbis, Opus or FLAC stream"
+		return err
+	}
+
+	finfo, _ := f.Stat()
+	fsize := finfo.Size()
+
+	*spf = 1
+	*sr = o.SampleRate
+	*ch = o.Channels
+	*frames = int(o.samples)
+	playtime := float64(o.samples) / float64(o.SampleRate)
+	if playtime > 0 {
+		*br = float64(fsize) / playtime * 8 / 1000
+	}
+
+	logger.Log("codec     : "+o.Codec, logger.LOG_DEBUG)
+	logger.Log("pages     : "+strconv.Itoa(pages), logger.LOG_DEBUG)
+	logger.Log("samples   : "+strconv.Itoa(*frames), logger.LOG_DEBUG)
+	logger.Log("samplerate: "+strconv.Itoa(*sr)+" Hz", logger.LOG_DEBUG)
+	logger.Log("channels  : "+strconv.Itoa(*ch), logger.LOG_DEBUG)
+	logger.Log("playtime  : "+strconv.Itoa(int(playtime))+" sec", logger.LOG_DEBUG)
+	logger.Log("bitrate   : "+strconv.Itoa(int(*br))+" kbps (average)", logger.LOG_DEBUG)
+
+	return nil
+}
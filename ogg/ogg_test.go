@@ -0,0 +1,355 @@
+package ogg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func vorbisHead(rate uint32, channels byte) []byte {
+	b := make([]byte, 30)
+	b[0] = 0x01
+	copy(b[1:], "vorbis")
+	b[11] = channels
+	binary.LittleEndian.PutUint32(b[12:], rate)
+	return b
+}
+
+func opusHead(channels byte) []byte {
+	b := make([]byte, 19)
+	copy(b, "OpusHead")
+	b[8] = 1
+	b[9] = channels
+	return b
+}
+
+// Ogg FLAC mapping header with STREAMINFO of 44100 Hz stereo
+func flacHead() []byte {
+	b := make([]byte, 51)
+	b[0] = 0x7F
+	copy(b[1:], "FLAC")
+	copy(b[9:], "fLaC")
+	si := b[17:]
+	si[10], si[11], si[12] = 0x0A, 0xC4, 0x42
+	return b
+}
+
+// a page with whole packets
+func page(headerType byte, granule int64, serial, seq uint32, packets ...[]byte) *Page {
+	p := &Page{HeaderType: headerType, Granule: granule, Serial: serial, Sequence: seq}
+	for _, packet := range packets {
+		p.Segments = append(p.Segments, Lacing(len(packet))...)
+		p.Body = append(p.Body, packet...)
+	}
+	return p
+}
+
+func pages(pp ...*Page) []byte {
+	var b []byte
+	for _, p := range pp {
+		b = append(b, p.Bytes()...)
+	}
+	return b
+}
+
+func TestCRC(t *testing.T) {
+	// CRC-32/MPEG-2 polynomial without the initial and final inversion
+	if got := crc([]byte("123456789")); got != 0x89A1897F {
+		t.Errorf("crc() = 0x%08X, want 0x89A1897F", got)
+	}
+
+	b := page(HeaderBOS, 0, 1234, 0, vorbisHead(44100, 2)).Bytes()
+	got := binary.LittleEndian.Uint32(b[22:])
+	binary.LittleEndian.PutUint32(b[22:], 0)
+	if want := crc(b); got != want {
+		t.Errorf("Page.Bytes() checksum = 0x%08X, want 0x%08X", got, want)
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	p := page(HeaderBOS|HeaderEOS, 12345, 0xDEADBEEF, 7, []byte("packet"), make([]byte, 300))
+	tests := []struct {
+		name string
+		data []byte
+		err  bool
+	}{
+		{"page", p.Bytes(), false},
+		{"garbage before", append([]byte("garbage"), p.Bytes()...), false},
+		{"bad version", append(append([]byte("OggS"), 1), p.Bytes()[5:]...), true},
+		{"truncated header", p.Bytes()[:20], true},
+		{"truncated body", p.Bytes()[:len(p.Bytes())-1], true},
+		{"no page", []byte("garbage"), true},
+	}
+	for _, tt := range tests {
+		got, err := ReadPage(bufio.NewReader(bytes.NewReader(tt.data)))
+		if tt.err {
+			if err == nil {
+				t.Errorf("ReadPage(%s) didn't fail", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadPage(%s) failed: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got.Bytes(), p.Bytes()) {
+			t.Errorf("ReadPage(%s) = %+v, want %+v", tt.name, *got, *p)
+		}
+	}
+}
+
+func TestPackets(t *testing.T) {
+	tests := []struct {
+		segments []byte
+		want     []int // packet sizes
+	}{
+		{[]byte{10}, []int{10}},
+		{[]byte{10, 0, 20}, []int{10, 0, 20}},
+		{[]byte{255, 10}, []int{265}},
+		{[]byte{255, 0, 5}, []int{255, 5}},
+		// continues on the next page
+		{[]byte{5, 255, 255}, []int{5, 510}},
+	}
+	for _, tt := range tests {
+		size := 0
+		for _, l := range tt.segments {
+			size += int(l)
+		}
+		packets := Packets(tt.segments, make([]byte, size))
+		var got []int
+		for _, p := range packets {
+			got = append(got, len(p))
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Packets(%v) sizes = %v, want %v", tt.segments, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Packets(%v) sizes = %v, want %v", tt.segments, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLacing(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0}},
+		{100, []byte{100}},
+		{255, []byte{255, 0}},
+		{600, []byte{255, 255, 90}},
+	}
+	for _, tt := range tests {
+		if got := Lacing(tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("Lacing(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	w := NewWriter()
+	// the first packet spans two pages
+	big := make([]byte, 255*255+100)
+	data := append(w.Packet(big, 0), w.Packet([]byte("audio"), 4096)...)
+	data = append(data, w.End(4096)...)
+
+	want := []struct {
+		headerType byte
+		granule    int64
+		size       int
+	}{
+		{HeaderBOS, noGranule, 255 * 255},
+		{HeaderContinued, 0, 100},
+		{0, 4096, 5},
+		{HeaderEOS, 4096, 0},
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	for i, tt := range want {
+		p, err := ReadPage(r)
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		if p.HeaderType != tt.headerType || p.Granule != tt.granule || len(p.Body) != tt.size ||
+			p.Serial != w.serial || p.Sequence != uint32(i) {
+			t.Errorf("page %d = type %d granule %d size %d serial %d seq %d, want type %d granule %d size %d serial %d seq %d",
+				i, p.HeaderType, p.Granule, len(p.Body), p.Serial, p.Sequence,
+				tt.headerType, tt.granule, tt.size, w.serial, i)
+		}
+	}
+	if _, err := ReadPage(r); err != io.EOF {
+		t.Errorf("ReadPage() after the last page = %v, want EOF", err)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	tests := []struct {
+		name           string
+		packet         []byte
+		codec          string
+		rate, channels int
+	}{
+		{"vorbis", vorbisHead(44100, 2), "vorbis", 44100, 2},
+		{"opus", opusHead(1), "opus", 48000, 1},
+		{"flac", flacHead(), "flac", 44100, 2},
+		{"short vorbis", vorbisHead(44100, 2)[:10], "", 0, 0},
+		{"unknown", []byte("Speex   1.2"), "", 0, 0},
+	}
+	for _, tt := range tests {
+		codec, rate, channels := identify(tt.packet)
+		if codec != tt.codec || rate != tt.rate || channels != tt.channels {
+			t.Errorf("identify(%s) = %q, %d, %d, want %q, %d, %d", tt.name, codec, rate, channels, tt.codec, tt.rate, tt.channels)
+		}
+	}
+}
+
+func TestReaderSerials(t *testing.T) {
+	// two chained streams with the same serial, like two tracks cut
+	// from one encoder
+	data := pages(
+		page(HeaderBOS, 0, 1, 0, vorbisHead(44100, 2)),
+		page(0, 0, 1, 1, []byte("comment"), []byte("setup")),
+		page(0, 1000, 1, 2, []byte("audio")),
+		page(HeaderEOS, 2000, 1, 3, []byte("audio")),
+		page(HeaderBOS, 0, 1, 0, opusHead(2)),
+		page(0, 960, 1, 1, []byte("audio")),
+	)
+	o := NewReader(bytes.NewReader(data))
+	buf, err := o.ReadSamples(1 << 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Codec != "vorbis" || o.SampleRate != 44100 || o.Channels != 2 {
+		t.Errorf("Reader codec = %q, %d, %d, want vorbis, 44100, 2", o.Codec, o.SampleRate, o.Channels)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(buf))
+	var serials []uint32
+	for {
+		p, err := ReadPage(r)
+		if err != nil {
+			break
+		}
+		serials = append(serials, p.Serial)
+	}
+	if len(serials) != 6 {
+		t.Fatalf("Reader returned %d pages, want 6", len(serials))
+	}
+	for i, s := range serials {
+		first := i < 4
+		if first && s != serials[0] || !first && s != serials[4] {
+			t.Errorf("page %d serial %d isn't the serial of its stream", i, s)
+		}
+	}
+	if serials[0] == serials[4] {
+		t.Error("chained streams have the same serial")
+	}
+}
+
+func TestReadSamples(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    int64 // granule of the first audio page
+		requests []int
+		want     []int // pages returned for every request
+	}{
+		// 1000 samples a page, the headers come with the first audio page
+		{"from 0", 1000, []int{1000, 1000, 1500, 500, 1000}, []int{3, 1, 2, 0, 1}},
+		// the first page of a stream cut from the middle is the baseline,
+		// it's sent at once
+		{"from the middle", 50000000, []int{500, 1000, 1000}, []int{4, 1, 1}},
+	}
+	for _, tt := range tests {
+		pp := []*Page{
+			page(HeaderBOS, 0, 1, 0, vorbisHead(44100, 2)),
+			page(0, 0, 1, 1, []byte("comment"), []byte("setup")),
+		}
+		for i := int64(0); i < 10; i++ {
+			pp = append(pp, page(0, tt.start+i*1000, 1, uint32(i+2), []byte("audio")))
+		}
+		o := NewReader(bytes.NewReader(pages(pp...)))
+		for i, n := range tt.requests {
+			buf, err := o.ReadSamples(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := 0
+			r := bufio.NewReader(bytes.NewReader(buf))
+			for {
+				if _, err := ReadPage(r); err != nil {
+					break
+				}
+				got++
+			}
+			if got != tt.want[i] {
+				t.Errorf("ReadSamples(%s) request %d returned %d pages, want %d", tt.name, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestFinish(t *testing.T) {
+	data := pages(
+		page(HeaderBOS, 0, 1, 0, vorbisHead(44100, 2)),
+		page(0, 0, 1, 1, []byte("comment"), []byte("setup")),
+		page(0, 1000, 1, 2, []byte("audio")),
+		page(0, 2000, 1, 3, []byte("audio")),
+		page(HeaderEOS, 3000, 1, 4, []byte("audio")),
+	)
+	tests := []struct {
+		name    string
+		samples int
+		eos     bool  // an EOS page is returned
+		granule int64 // of the EOS page
+		seq     uint32
+	}{
+		{"not started", 0, false, 0, 0},
+		{"stopped in the middle", 1500, true, 2000, 4},
+		{"ended", 1 << 20, false, 0, 0},
+	}
+	for _, tt := range tests {
+		o := NewReader(bytes.NewReader(data))
+		var buf []byte
+		if tt.samples > 0 {
+			buf, _ = o.ReadSamples(tt.samples)
+		}
+		end := o.Finish()
+		if !tt.eos {
+			if len(end) != 0 {
+				t.Errorf("Finish(%s) returned %d bytes, want none", tt.name, len(end))
+			}
+			continue
+		}
+		read := readAll(buf)
+		got := readAll(end)
+		if len(got) != 1 {
+			t.Errorf("Finish(%s) returned %d pages, want 1", tt.name, len(got))
+			continue
+		}
+		p := got[0]
+		if p.HeaderType != HeaderEOS || p.Granule != tt.granule || p.Sequence != tt.seq ||
+			p.Serial != read[0].Serial || len(p.Body) != 0 {
+			t.Errorf("Finish(%s) = %+v, want EOS granule %d seq %d serial %d", tt.name, *p, tt.granule, tt.seq, read[0].Serial)
+		}
+		if len(o.Finish()) != 0 {
+			t.Errorf("Finish(%s) again returned a page", tt.name)
+		}
+	}
+}
+
+func readAll(b []byte) []*Page {
+	var pp []*Page
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		p, err := ReadPage(r)
+		if err != nil {
+			return pp
+		}
+		pp = append(pp, p)
+	}
+}
@@ -0,0 +1,220 @@
+package playlist
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stunndard/goicy/logger"
+)
+
+// audio file extensions of the stream formats in file mode
+var formatExts = map[string][]string{
+	"mpeg":   {".mp3", ".mp2", ".mp1", ".mpa"},
+	"aac":    {".aac", ".m4a", ".mp4"},
+	"ogg":    {".ogg", ".oga", ".opus"},
+	"vorbis": {".ogg", ".oga"},
+	"opus":   {".opus", ".ogg"},
+	"flac":   {".flac"},
+}
+
+// more extensions ffmpeg can read
+var ffmpegExts = []string{".wav", ".wma", ".ape", ".wv", ".mpc", ".aiff", ".aif", ".alac", ".ac3"}
+
+// watched playlist directory
+type dirWatch struct {
+	p       *Playlist
+	dir     string
+	watcher *fsnotify.Watcher
+	done    chan struct{} // closed when run returns
+}
+
+// a new file is added when nothing was written to it for this long,
+// so the files still being copied are not played
+const settleTime = 2 * time.Second
+
+// whether the file has an extension that can be streamed
+func (p *Playlist) supported(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	var exts []string
+	if p.cfg.StreamType == "file" {
+		exts = formatExts[p.cfg.StreamFormat]
+	} else {
+		for _, e := range formatExts {
+			exts = append(exts, e...)
+		}
+		exts = append(exts, ffmpegExts...)
+	}
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func isDir(name string) bool {
+	finfo, err := os.Stat(name)
+	return err == nil && finfo.IsDir()
+}
+
+// finds the supported files in the dir and its subdirs, in name order
+func (p *Playlist) scanDir(dir string) []Entry {
+	var entries []Entry
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logger.Log("Cannot scan "+path+": "+err.Error(), logger.LOG_DEBUG)
+			return nil
+		}
+		if !info.IsDir() && p.supported(path) {
+			entries = append(entries, Entry{File: path})
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].File < entries[j].File })
+	return entries
+}
+
+// loads the playlist directory, the tracks are kept up to date by
+// watching the directory, so it's scanned only once. If it can't be
+// watched, it's scanned on every call.
+func (p *Playlist) loadDir(dir string) {
+	if p.watched != nil && p.watched.dir == dir {
+		return
+	}
+	p.stopWatch()
+
+	entries := p.scanDir(dir)
+	p.readArtists(entries)
+	p.mu.Lock()
+	p.entries = entries
+	p.mu.Unlock()
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Log("Cannot watch playlist directory: "+err.Error(), logger.LOG_ERROR)
+		return
+	}
+	p.watched = &dirWatch{p: p, dir: dir, watcher: w, done: make(chan struct{})}
+	p.watched.add(dir)
+	go p.watched.run()
+	logger.Log("Watching playlist directory: "+dir, logger.LOG_INFO)
+}
+
+// stops watching the playlist directory, the playlist is
+// not changed by the watch after it returns
+func (p *Playlist) stopWatch() {
+	if p.watched != nil {
+		p.watched.watcher.Close()
+		<-p.watched.done
+		p.watched = nil
+	}
+}
+
+// watches the dir and its subdirs, fsnotify is not recursive
+func (d *dirWatch) add(dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			if err := d.watcher.Add(path); err != nil {
+				logger.Log("Cannot watch "+path+": "+err.Error(), logger.LOG_ERROR)
+			}
+		}
+		return nil
+	})
+}
+
+// updates the playlist on the directory changes
+func (d *dirWatch) run() {
+	defer close(d.done)
+
+	// new files by the time they were last written to
+	pending := make(map[string]time.Time)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case ev, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			switch {
+			case ev.Has(fsnotify.Create):
+				if isDir(ev.Name) {
+					// a moved in dir is not empty
+					d.add(ev.Name)
+					for _, e := range d.p.scanDir(ev.Name) {
+						pending[e.File] = time.Now()
+					}
+				} else if d.p.supported(ev.Name) {
+					pending[ev.Name] = time.Now()
+				}
+			case ev.Has(fsnotify.Write):
+				if _, ok := pending[ev.Name]; ok {
+					pending[ev.Name] = time.Now()
+				}
+			case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+				prefix := ev.Name + string(filepath.Separator)
+				for name := range pending {
+					if name == ev.Name || strings.HasPrefix(name, prefix) {
+						delete(pending, name)
+					}
+				}
+				d.p.removeEntries(ev.Name)
+			}
+		case <-tick.C:
+			for name, written := range pending {
+				if time.Since(written) >= settleTime {
+					delete(pending, name)
+					d.p.insertEntry(Entry{File: name})
+				}
+			}
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Log("Playlist directory watch error: "+err.Error(), logger.LOG_ERROR)
+		}
+	}
+}
+
+// adds the file to the playlist in name order, keeping the current track
+func (p *Playlist) insertEntry(e Entry) {
+	p.readArtists([]Entry{e})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := sort.Search(len(p.entries), func(i int) bool { return p.entries[i].File >= e.File })
+	if i < len(p.entries) && p.entries[i].File == e.File {
+		return
+	}
+	p.entries = append(p.entries, Entry{})
+	copy(p.entries[i+1:], p.entries[i:])
+	p.entries[i] = e
+	if i <= p.idx && len(p.entries) > 1 {
+		p.idx++
+	}
+	logger.Log("Added to playlist: "+e.File, logger.LOG_DEBUG)
+}
+
+// removes the file, or all files of the dir, from the playlist
+func (p *Playlist) removeEntries(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prefix := name + string(filepath.Separator)
+	n := 0
+	for i, e := range p.entries {
+		if e.File == name || strings.HasPrefix(e.File, prefix) {
+			if i < p.idx {
+				p.idx--
+			}
+			logger.Log("Removed from playlist: "+e.File, logger.LOG_DEBUG)
+			continue
+		}
+		p.entries[n] = e
+		n++
+	}
+	p.entries = p.entries[:n]
+}
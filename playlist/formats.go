@@ -0,0 +1,206 @@
+package playlist
+
+import (
+	"encoding/xml"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stunndard/goicy/metadata"
+)
+
+// playlist file formats
+const (
+	formatPlain = "internal"
+	formatM3U   = "m3u"
+	formatPLS   = "pls"
+	formatXSPF  = "xspf"
+)
+
+// returns the format of the playlist, set by playlisttype
+// or guessed from the file extension
+func playlistFormat(filename, playlistType string) string {
+	switch strings.ToLower(playlistType) {
+	case "m3u", "m3u8":
+		return formatM3U
+	case "pls":
+		return formatPLS
+	case "xspf":
+		return formatXSPF
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".m3u", ".m3u8":
+		return formatM3U
+	case ".pls":
+		return formatPLS
+	case ".xspf":
+		return formatXSPF
+	}
+	return formatPlain
+}
+
+// parses the playlist file content into entries, the files are not checked
+func parsePlaylist(filename, format string, content []byte) ([]Entry, error) {
+	text := strings.TrimPrefix(string(content), "\uFEFF")
+	dir := filepath.Dir(filename)
+	switch format {
+	case formatM3U:
+		return parseM3U(text, dir), nil
+	case formatPLS:
+		return parsePLS(text, dir), nil
+	case formatXSPF:
+		return parseXSPF(content, dir)
+	}
+
+	// one file on a line, relative to the current dir
+	var entries []Entry
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Replace(line, "\r", "", -1)
+		if line != "" {
+			entries = append(entries, Entry{File: line})
+		}
+	}
+	return entries, nil
+}
+
+// resolves the playlist location against the playlist dir,
+// URLs are returned as is
+func location(loc, dir string) string {
+	loc = strings.TrimSpace(loc)
+	if strings.HasPrefix(strings.ToLower(loc), "file://") {
+		if u, err := url.Parse(loc); err == nil {
+			loc = filepath.FromSlash(u.Path)
+		}
+	}
+	if loc == "" || strings.Contains(loc, "://") || filepath.IsAbs(loc) {
+		return loc
+	}
+	return filepath.Join(dir, loc)
+}
+
+// splits the "Artist - Title" display title into fields
+func titleFields(title string) map[string]string {
+	title = strings.TrimSpace(metadata.ToUTF8(title))
+	if title == "" {
+		return nil
+	}
+	if i := strings.Index(title, " - "); i > 0 {
+		return map[string]string{
+			"artist": strings.TrimSpace(title[:i]),
+			"title":  strings.TrimSpace(title[i+3:]),
+		}
+	}
+	return map[string]string{"title": title}
+}
+
+// parses M3U and M3U8 playlist, #EXTINF titles are used
+// when the file has no tags
+func parseM3U(text, dir string) []Entry {
+	var entries []Entry
+	var extinf map[string]string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(strings.ToUpper(line), "#EXTINF:") {
+				extinf = titleFields(extinfTitle(line[8:]))
+			}
+			continue
+		}
+		entries = append(entries, Entry{File: location(line, dir), Fallback: extinf})
+		extinf = nil
+	}
+	return entries
+}
+
+// returns the title of "#EXTINF:duration [attributes],title",
+// commas in quoted attribute values are skipped
+func extinfTitle(s string) string {
+	quoted := false
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			return s[i+1:]
+		}
+	}
+	return ""
+}
+
+// parses PLS playlist, the entries are ordered by their numbers
+func parsePLS(text, dir string) []Entry {
+	files := make(map[int]string)
+	titles := make(map[int]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(line[:eq])), line[eq+1:]
+		switch {
+		case strings.HasPrefix(key, "file"):
+			if n, err := strconv.Atoi(key[4:]); err == nil {
+				files[n] = value
+			}
+		case strings.HasPrefix(key, "title"):
+			if n, err := strconv.Atoi(key[5:]); err == nil {
+				titles[n] = value
+			}
+		}
+	}
+
+	var nums []int
+	for n := range files {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	var entries []Entry
+	for _, n := range nums {
+		entries = append(entries, Entry{File: location(files[n], dir), Fallback: titleFields(titles[n])})
+	}
+	return entries
+}
+
+type xspfPlaylist struct {
+	Tracks []struct {
+		Location []string `xml:"location"`
+		Title    string   `xml:"title"`
+		Creator  string   `xml:"creator"`
+		Album    string   `xml:"album"`
+	} `xml:"trackList>track"`
+}
+
+// parses XSPF playlist, the first location of a track is used
+func parseXSPF(content []byte, dir string) ([]Entry, error) {
+	var pl xspfPlaylist
+	if err := xml.Unmarshal(content, &pl); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, t := range pl.Tracks {
+		if len(t.Location) == 0 {
+			continue
+		}
+		loc := t.Location[0]
+		if !strings.Contains(loc, "://") {
+			// relative locations are URI references
+			if p, err := url.PathUnescape(loc); err == nil {
+				loc = filepath.FromSlash(p)
+			}
+		}
+		fields := make(map[string]string)
+		for k, v := range map[string]string{"title": t.Title, "artist": t.Creator, "album": t.Album} {
+			if v = strings.TrimSpace(v); v != "" {
+				fields[k] = v
+			}
+		}
+		entries = append(entries, Entry{File: location(loc, dir), Fallback: fields})
+	}
+	return entries, nil
+}
@@ -0,0 +1,127 @@
+package playlist
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPlaylistFormat(t *testing.T) {
+	tests := []struct {
+		filename, playlistType, want string
+	}{
+		{"list.txt", "", formatPlain},
+		{"list.m3u", "", formatM3U},
+		{"list.M3U8", "", formatM3U},
+		{"list.pls", "", formatPLS},
+		{"list.xspf", "", formatXSPF},
+		{"list.txt", "m3u8", formatM3U},
+		{"list.m3u", "PLS", formatPLS},
+		{"list", "xspf", formatXSPF},
+	}
+	for _, tt := range tests {
+		if got := playlistFormat(tt.filename, tt.playlistType); got != tt.want {
+			t.Errorf("playlistFormat(%q, %q) = %q, want %q", tt.filename, tt.playlistType, got, tt.want)
+		}
+	}
+}
+
+// compares the files and fallback fields, nil and empty fields are the same
+func sameEntries(a, b []Entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].File != b[i].File || len(a[i].Fallback) != len(b[i].Fallback) {
+			return false
+		}
+		for k, v := range a[i].Fallback {
+			if b[i].Fallback[k] != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestParsePlaylist(t *testing.T) {
+	dir := filepath.FromSlash("/music")
+	abs := filepath.FromSlash("/other/c.mp3")
+	in := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		want    []Entry
+	}{
+		{"plain", formatPlain, "\uFEFFa.mp3\r\n\r\nsub/b.mp3\n",
+			[]Entry{{File: "a.mp3"}, {File: "sub/b.mp3"}}},
+		{"M3U", formatM3U, "#EXTM3U\r\n" +
+			"#EXTINF:123,Artist - Title\r\n" +
+			"a.mp3\r\n" +
+			"# comment\n" +
+			"sub/b.mp3\n" +
+			"#EXTINF:-1 tvg-name=\"x, y\",Only Title\n" +
+			abs + "\n" +
+			"http://example.com/stream\n",
+			[]Entry{
+				{File: in("a.mp3"), Fallback: map[string]string{"artist": "Artist", "title": "Title"}},
+				{File: in("sub/b.mp3")},
+				{File: abs, Fallback: map[string]string{"title": "Only Title"}},
+				{File: "http://example.com/stream"},
+			}},
+		{"M3U Latin-1 title", formatM3U, "#EXTINF:1,Caf\xe9\na.mp3\n",
+			[]Entry{{File: in("a.mp3"), Fallback: map[string]string{"title": "Café"}}}},
+		{"M3U file URL", formatM3U, "file:///other/c.mp3\n",
+			[]Entry{{File: abs}}},
+		{"PLS", formatPLS, "[playlist]\n" +
+			"File2=b.mp3\n" +
+			"Title2=Artist - Second\n" +
+			"File1=a.mp3\n" +
+			"File10=c.mp3\n" +
+			"Title1=First\n" +
+			"FileX=bad.mp3\n" +
+			"NumberOfEntries=3\n" +
+			"Version=2\n",
+			[]Entry{
+				{File: in("a.mp3"), Fallback: map[string]string{"title": "First"}},
+				{File: in("b.mp3"), Fallback: map[string]string{"artist": "Artist", "title": "Second"}},
+				{File: in("c.mp3")},
+			}},
+		{"XSPF", formatXSPF, `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <trackList>
+    <track>
+      <location>a%20b.mp3</location>
+      <location>ignored.mp3</location>
+      <title>Title</title>
+      <creator>Artist</creator>
+      <album>Album</album>
+    </track>
+    <track>
+      <title>No location</title>
+    </track>
+    <track>
+      <location>file:///other/c.mp3</location>
+    </track>
+  </trackList>
+</playlist>`,
+			[]Entry{
+				{File: in("a b.mp3"), Fallback: map[string]string{"title": "Title", "artist": "Artist", "album": "Album"}},
+				{File: abs},
+			}},
+	}
+	for _, tt := range tests {
+		got, err := parsePlaylist(filepath.Join(dir, "list"), tt.format, []byte(tt.content))
+		if err != nil {
+			t.Errorf("parsePlaylist(%s) failed: %v", tt.name, err)
+			continue
+		}
+		if !sameEntries(got, tt.want) {
+			t.Errorf("parsePlaylist(%s) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parsePlaylist("list.xspf", formatXSPF, []byte("<playlist><trackList>")); err == nil {
+		t.Error("parsePlaylist() of broken XSPF didn't fail")
+	}
+}
@@ -0,0 +1,141 @@
+package playlist
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stunndard/goicy/logger"
+)
+
+// NowPlaying is the playing track saved to the npfile
+type NowPlaying struct {
+	Entry  Entry
+	Index  int           // index of the entry in the playlist
+	Offset time.Duration // position in the entry
+}
+
+// Index returns the index of the current entry in the playlist
+func (p *Playlist) Index() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.idx
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+func parseSeconds(s string) time.Duration {
+	f, _ := strconv.ParseFloat(s, 64)
+	return time.Duration(f * float64(time.Second))
+}
+
+// SaveNowPlaying writes the playing track to the file. The file is
+// replaced at once so it's never left half written.
+func SaveNowPlaying(filename string, np NowPlaying) error {
+	content := "file=" + np.Entry.File + "\n" +
+		"start=" + seconds(np.Entry.Start) + "\n" +
+		"end=" + seconds(np.Entry.End) + "\n" +
+		"index=" + strconv.Itoa(np.Index) + "\n" +
+		"offset=" + seconds(np.Offset) + "\n"
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// LoadNowPlaying reads the track saved by SaveNowPlaying
+func LoadNowPlaying(filename string) (*NowPlaying, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	np := &NowPlaying{Index: -1}
+	for _, line := range strings.Split(string(content), "\n") {
+		kv := strings.SplitN(strings.TrimRight(line, "\r"), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "file":
+			np.Entry.File = kv[1]
+		case "start":
+			np.Entry.Start = parseSeconds(kv[1])
+		case "end":
+			np.Entry.End = parseSeconds(kv[1])
+		case "index":
+			if n, err := strconv.Atoi(kv[1]); err == nil {
+				np.Index = n
+			}
+		case "offset":
+			np.Offset = parseSeconds(kv[1])
+		}
+	}
+	return np, nil
+}
+
+// Resume returns the playlist entry saved in the npfile and the position
+// in it, and continues the playlist from there. If the playlist was edited
+// and the track is not in it anymore, the track that took its place is
+// returned from the beginning. ok is false if there is nothing to resume.
+func (p *Playlist) Resume(filename string) (entry Entry, offset time.Duration, ok bool) {
+	saved, err := LoadNowPlaying(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Log("Cannot read npfile: "+err.Error(), logger.LOG_ERROR)
+		}
+		return Entry{}, 0, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.entries) == 0 || saved.Entry.File == "" {
+		return Entry{}, 0, false
+	}
+
+	// the entry is looked up by its file, the index is a hint
+	// for the playlists with the same file many times
+	found := -1
+	for i, e := range p.entries {
+		// the start is saved in milliseconds
+		d := e.Start - saved.Entry.Start
+		if e.File == saved.Entry.File && d > -time.Millisecond && d < time.Millisecond {
+			if found < 0 || abs(i-saved.Index) < abs(found-saved.Index) {
+				found = i
+			}
+		}
+	}
+	if found >= 0 {
+		p.idx = found
+		if p.cfg.PlayRandom {
+			p.mark(&p.shuffled, p.entries[p.idx])
+		}
+		logger.Log("Resuming from "+p.entries[p.idx].String()+" at "+saved.Offset.String(), logger.LOG_INFO)
+		return p.entries[p.idx], saved.Offset, true
+	}
+
+	if saved.Index < 0 {
+		return Entry{}, 0, false
+	}
+	p.idx = saved.Index
+	if p.idx > len(p.entries)-1 {
+		p.idx = 0
+	}
+	if p.cfg.PlayRandom {
+		p.mark(&p.shuffled, p.entries[p.idx])
+	}
+	logger.Log("Track "+saved.Entry.String()+" is not in the playlist, resuming from "+
+		p.entries[p.idx].String(), logger.LOG_INFO)
+	return p.entries[p.idx], 0, true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -3,72 +3,290 @@ package playlist
 import (
 	"errors"
 	"github.com/stunndard/goicy/config"
+	"github.com/stunndard/goicy/cuesheet"
+	"github.com/stunndard/goicy/logger"
 	"github.com/stunndard/goicy/util"
 	"io/ioutil"
-	"math/rand"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
-var playlist []string
-var idx int
-var np string
+// Entry is a single track of the playlist. Tracks of a cuesheet
+// are parts of a file, from Start to End.
+type Entry struct {
+	File   string
+	Start  time.Duration     // offset of the track in the file
+	End    time.Duration     // end of the track in the file, 0 for the end of file
+	Fields map[string]string // metadata fields of the track, like the cuesheet tags
 
-func First() string {
-	if len(playlist) > 0 {
-		return playlist[0]
+	// metadata fields used when the file has no such tags,
+	// like the titles of M3U, PLS and XSPF playlists
+	Fallback map[string]string
+}
+
+// String returns the file name, with the offsets for cuesheet tracks
+func (e Entry) String() string {
+	if e.Start == 0 && e.End == 0 {
+		return e.File
+	}
+	s := e.File + " @" + e.Start.String()
+	if e.End > 0 {
+		s += "-" + e.End.String()
+	}
+	return s
+}
+
+// IsPart returns whether the entry is a part of the file
+func (e Entry) IsPart() bool {
+	return e.Start > 0 || e.End > 0
+}
+
+func (e Entry) same(o Entry) bool {
+	return e.File == o.File && e.Start == o.Start && e.End == o.End
+}
+
+// Playlist is the playlist of a streamer: its entries, the playing one,
+// the scheduled show, the shuffle and the requests. Its settings are
+// read from the config it was created with.
+type Playlist struct {
+	cfg *config.Config
+
+	// guards the state below, a watched directory and
+	// the request listener change it
+	mu       sync.Mutex
+	entries  []Entry
+	idx      int
+	np       Entry
+	shuffled bag
+	rot      *rotation
+
+	// artists of the recently played entries, the last one is the newest
+	recent []string
+	// artists of the files, the tags are read once
+	artists map[string]string
+
+	// watched playlist directory
+	watched *dirWatch
+
+	// the scheduled show on air, nil for the [playlist] one
+	active *config.Show
+
+	// requested entries, they are played before the playlist ones
+	requests []Entry
+	// time of the last request of every requester
+	requested map[string]time.Time
+}
+
+// New creates the playlist of cfg, it has to be loaded with Load
+func New(cfg *config.Config) *Playlist {
+	return &Playlist{
+		cfg:       cfg,
+		artists:   make(map[string]string),
+		requested: make(map[string]time.Time),
+	}
+}
+
+func (p *Playlist) First() Entry {
+	p.loadCategories()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rot != nil {
+		return p.nextRotation()
+	}
+	if len(p.entries) > 0 {
+		if p.cfg.PlayRandom {
+			p.idx = p.pick(&p.shuffled, p.entries, Entry{})
+			return p.entries[p.idx]
+		}
+		return p.entries[0]
 	} else {
-		return ""
+		return Entry{}
 	}
 }
 
-func Next() string {
+func (p *Playlist) Next() Entry {
+	return p.NextAt(time.Now())
+}
+
+// NextAt returns the next entry with the show on air at t, so a track
+// cut a bit ahead of the show start is followed by the show
+func (p *Playlist) NextAt(t time.Time) Entry {
+	// requests are played before the playlist
+	if e, ok := p.popRequest(); ok {
+		return e
+	}
+
+	// the scheduled playlist starts at the track boundary
+	if p.switchShow(t) {
+		if err := p.load(); err != nil {
+			logger.Log("Cannot load playlist: "+err.Error(), logger.LOG_ERROR)
+		}
+		return p.First()
+	}
+
 	//save_idx;
 
 	// get_next_file := pl.Strings[idx];
-	if idx > len(playlist)-1 {
-		idx = 0
-	}
-	np = playlist[idx]
-	Load()
-	if idx > len(playlist)-1 {
-		idx = 0
-	}
-	for (np == playlist[idx]) && (len(playlist) > 1) {
-		if !config.Cfg.PlayRandom {
-			idx = idx + 1
-			if idx > len(playlist)-1 {
-				idx = 0
-			}
-		} else {
-			idx = rand.Intn(len(playlist))
+	p.loadCategories()
+	p.mu.Lock()
+	if p.rot != nil {
+		defer p.mu.Unlock()
+		return p.nextRotation()
+	}
+	if p.idx > len(p.entries)-1 {
+		p.idx = 0
+	}
+	if len(p.entries) > 0 {
+		p.np = p.entries[p.idx]
+	}
+	p.mu.Unlock()
+	p.load()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.entries) == 0 {
+		// all files of the directory are gone
+		return Entry{}
+	}
+	if p.idx > len(p.entries)-1 {
+		p.idx = 0
+	}
+	if p.cfg.PlayRandom {
+		p.idx = p.pick(&p.shuffled, p.entries, p.np)
+		return p.entries[p.idx]
+	}
+	for p.np.same(p.entries[p.idx]) && (len(p.entries) > 1) {
+		p.idx = p.idx + 1
+		if p.idx > len(p.entries)-1 {
+			p.idx = 0
 		}
 	}
-	return playlist[idx]
+	return p.entries[p.idx]
 }
 
-func Load() error {
-	if ok := util.FileExists(config.Cfg.Playlist); !ok {
-		return errors.New("Playlist file doesn't exist")
+func (p *Playlist) Load() error {
+	p.switchShow(time.Now())
+	return p.load()
+}
+
+// loads the playlist of the current show
+func (p *Playlist) load() error {
+	filename, playlistType := p.current()
+
+	if playlistType == typeRotation {
+		p.stopWatch()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.loadRotation()
+	}
+	p.mu.Lock()
+	p.rot = nil
+	p.mu.Unlock()
+
+	if isDir(filename) {
+		p.loadDir(filename)
+		p.mu.Lock()
+		n := len(p.entries)
+		p.mu.Unlock()
+		if n < 1 {
+			return errors.New("Error: no supported files in the playlist directory")
+		}
+		return nil
 	}
+	p.stopWatch()
 
-	content, err := ioutil.ReadFile(config.Cfg.Playlist)
+	list, err := loadFile(filename, playlistType)
 	if err != nil {
 		return err
 	}
-	playlist = strings.Split(string(content), "\n")
+	p.readArtists(list)
+	p.mu.Lock()
+	p.entries = list
+	p.mu.Unlock()
+	if len(list) < 1 {
+		return errors.New("Error: all files in the playlist do not exist")
+	}
+
+	return nil
+}
+
+// reads the playlist file, the files that don't exist are left out
+func loadFile(filename, playlistType string) ([]Entry, error) {
+	if ok := util.FileExists(filename); !ok {
+		return nil, errors.New("Playlist file doesn't exist")
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	format := playlistFormat(filename, playlistType)
+	entries, err := parsePlaylist(filename, format, content)
+	if err != nil {
+		return nil, err
+	}
 
-	i := 0
-	for i < len(playlist) {
-		playlist[i] = strings.Replace(playlist[i], "\r", "", -1)
-		if ok := util.FileExists(playlist[i]); !ok && !strings.HasPrefix(playlist[i], "http") {
-			playlist = append(playlist[:i], playlist[i+1:]...)
+	var list []Entry
+	for _, e := range entries {
+		if strings.EqualFold(filepath.Ext(e.File), ".cue") {
+			// every track of the cuesheet is a playlist entry
+			list = append(list, cueEntries(e.File)...)
 			continue
 		}
-		i += 1
+		if ok := util.FileExists(e.File); !ok && !strings.Contains(e.File, "://") {
+			continue
+		}
+		list = append(list, e)
 	}
-	if len(playlist) < 1 {
-		return errors.New("Error: all files in the playlist do not exist")
+	return list, nil
+}
+
+// audio file extensions tried when the cuesheet FILE doesn't exist
+var audioExts = []string{".flac", ".mp3", ".m4a", ".aac", ".mp4", ".mp2", ".ogg", ".opus"}
+
+// expands the cuesheet into its tracks
+func cueEntries(cuefile string) []Entry {
+	if !util.FileExists(cuefile) {
+		return nil
+	}
+	cue, err := cuesheet.ParseFile(cuefile)
+	if err != nil {
+		logger.Log("Cannot load cuesheet "+cuefile+": "+err.Error(), logger.LOG_ERROR)
+		return nil
 	}
 
-	return nil
+	var entries []Entry
+	for _, t := range cue.Tracks {
+		file := audioFile(t.File, cuefile)
+		if file == "" {
+			logger.Log("Cannot find audio file "+t.File+" of cuesheet "+cuefile, logger.LOG_DEBUG)
+			continue
+		}
+		entries = append(entries, Entry{
+			File:   file,
+			Start:  t.StartTime(),
+			End:    t.EndTime(),
+			Fields: cue.Fields(t),
+		})
+	}
+	return entries
+}
+
+// finds the audio file of the cuesheet, which is often converted
+// to another format after the cuesheet was made
+func audioFile(file, cuefile string) string {
+	if util.FileExists(file) {
+		return file
+	}
+	for _, base := range []string{util.Basename(file), util.Basename(cuefile)} {
+		for _, ext := range audioExts {
+			if util.FileExists(base + ext) {
+				return base + ext
+			}
+		}
+	}
+	return ""
 }
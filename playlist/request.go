@@ -0,0 +1,195 @@
+package playlist
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/util"
+)
+
+// errors of AddRequest
+var (
+	ErrNotFound  = errors.New("Track is not in the library")
+	ErrAmbiguous = errors.New("More than one track matches the request")
+	ErrQueued    = errors.New("Track is already requested")
+	ErrTooSoon   = errors.New("Too many requests, try again later")
+	ErrQueueFull = errors.New("Request queue is full")
+)
+
+// returns all entries that can be requested. The categories that were
+// not played yet are read without holding the lock.
+func (p *Playlist) library() []Entry {
+	p.mu.Lock()
+	rot := p.rot
+	var unloaded []*category
+	if rot != nil {
+		for _, c := range rot.categories {
+			if c.entries == nil {
+				unloaded = append(unloaded, c)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	loaded := make(map[*category][]Entry)
+	for _, c := range unloaded {
+		loaded[c] = p.readCategory(c)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries := append([]Entry(nil), p.entries...)
+	if p.rot != nil {
+		for _, c := range p.rot.categories {
+			// it could be loaded meanwhile by the rotation
+			if e, ok := loaded[c]; ok && c.entries == nil {
+				c.entries = e
+			}
+			entries = append(entries, c.entries...)
+		}
+	}
+	return entries
+}
+
+// whether the entry is the requested track: its file path, file name
+// with or without extension, or "artist - title" or title of its fields
+func matches(e Entry, track string) bool {
+	if e.IsPart() {
+		// all tracks of a cuesheet have the same file
+		title := e.Fields["title"]
+		return title != "" && (strings.EqualFold(track, title) ||
+			strings.EqualFold(track, e.Fields["artist"]+" - "+title))
+	}
+	name := filepath.Base(e.File)
+	return e.File == track || strings.EqualFold(name, track) ||
+		strings.EqualFold(util.Basename(name), track)
+}
+
+// AddRequest finds the track in the playlist and queues it to be played
+// next, after the tracks requested before. The track is a file path or
+// name, or "artist - title" of a cuesheet track. A requester can request
+// once in requestinterval seconds.
+func (p *Playlist) AddRequest(track, requester string) (Entry, error) {
+	return p.addRequest(track, requester, requester)
+}
+
+// queues the request of the requester, the interval is checked for the
+// client, which is the requester for AddRequest and the address for the
+// socket requests
+func (p *Playlist) addRequest(track, requester, client string) (Entry, error) {
+	track = strings.TrimSpace(track)
+	var found []Entry
+	for _, e := range p.library() {
+		if matches(e, track) {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		return Entry{}, ErrNotFound
+	}
+	if len(found) > 1 {
+		return Entry{}, ErrAmbiguous
+	}
+	e := found[0]
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, r := range p.requests {
+		if r.same(e) {
+			return Entry{}, ErrQueued
+		}
+	}
+	if p.cfg.RequestQueueSize > 0 && len(p.requests) >= p.cfg.RequestQueueSize {
+		return Entry{}, ErrQueueFull
+	}
+	interval := time.Duration(p.cfg.RequestInterval) * time.Second
+	if last, ok := p.requested[client]; ok && time.Since(last) < interval {
+		return Entry{}, ErrTooSoon
+	}
+	p.requested[client] = time.Now()
+
+	// the requested flag is a metadata field of the entry
+	fields := map[string]string{"requested": "1", "requester": requester}
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	e.Fields = fields
+	p.requests = append(p.requests, e)
+	logger.Log("Requested by "+requester+": "+e.String(), logger.LOG_INFO)
+	return e, nil
+}
+
+// Requests returns the queued requests
+func (p *Playlist) Requests() []Entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Entry(nil), p.requests...)
+}
+
+// returns the first queued request
+func (p *Playlist) popRequest() (Entry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.requests) == 0 {
+		return Entry{}, false
+	}
+	e := p.requests[0]
+	p.requests = p.requests[1:]
+	if p.cfg.PlayRandom && p.rot == nil {
+		// it's not played again in this shuffle cycle
+		p.mark(&p.shuffled, e)
+	}
+	return e, true
+}
+
+// ServeRequests accepts track requests on spec, tcp:host:port or
+// unix:/path/to/socket, until ctx is cancelled. Every line is a request,
+// "@name track" sets the requester name, otherwise it's the client
+// address. The interval is checked by the client address whatever the
+// name is, all unix socket clients have the same one. The answer is
+// "OK file" or "ERROR message".
+func (p *Playlist) ServeRequests(ctx context.Context, spec string) error {
+	n := strings.IndexByte(spec, ':')
+	if n < 0 || (spec[:n] != "tcp" && spec[:n] != "unix") {
+		return errors.New("Bad request input: " + spec)
+	}
+	kind, addr := spec[:n], spec[n+1:]
+	logger.Log("Accepting requests on "+kind+": "+addr, logger.LOG_INFO)
+	return util.Serve(ctx, kind, addr, p.serveRequests)
+}
+
+func (p *Playlist) serveRequests(conn net.Conn) {
+	client := "local"
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		client = host
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		requester := client
+		if strings.HasPrefix(line, "@") {
+			n := strings.IndexAny(line, " \t")
+			if n < 0 {
+				conn.Write([]byte("ERROR No track requested\n"))
+				continue
+			}
+			requester, line = line[1:n], strings.TrimSpace(line[n:])
+		}
+		e, err := p.addRequest(line, requester, client)
+		if err != nil {
+			conn.Write([]byte("ERROR " + err.Error() + "\n"))
+			continue
+		}
+		conn.Write([]byte("OK " + e.String() + "\n"))
+	}
+}
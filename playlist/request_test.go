@@ -0,0 +1,64 @@
+package playlist
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stunndard/goicy/config"
+)
+
+func TestAddRequest(t *testing.T) {
+	a := filepath.FromSlash("/music/a.mp3")
+	b := filepath.FromSlash("/music/b.mp3")
+	album := filepath.FromSlash("/music/album.flac")
+	p := New(&config.Config{RequestInterval: 300, RequestQueueSize: 2})
+	p.entries = []Entry{
+		{File: a},
+		{File: b},
+		{File: filepath.FromSlash("/other/a.mp3")},
+		{File: album, End: 3 * time.Minute, Fields: map[string]string{"artist": "Artist", "title": "One"}},
+		{File: album, Start: 3 * time.Minute, Fields: map[string]string{"artist": "Artist", "title": "Two"}},
+	}
+
+	// the requests are made in order, the queue and the intervals carry over
+	tests := []struct {
+		track, requester, client string
+		want                     Entry
+		err                      error
+	}{
+		{"nothing.mp3", "x", "x", Entry{}, ErrNotFound},
+		{"a.mp3", "x", "x", Entry{}, ErrAmbiguous},
+		{"album", "x", "x", Entry{}, ErrNotFound},
+		{a, "x", "x", Entry{File: a}, nil},
+		{" " + a + " ", "y", "y", Entry{}, ErrQueued},
+		{"B", "x", "x", Entry{}, ErrTooSoon},
+		{"b.mp3", "other name", "x", Entry{}, ErrTooSoon},
+		{"artist - two", "y", "y", Entry{File: album, Start: 3 * time.Minute}, nil},
+		{"b", "z", "z", Entry{}, ErrQueueFull},
+	}
+	for _, tt := range tests {
+		got, err := p.addRequest(tt.track, tt.requester, tt.client)
+		if err != tt.err {
+			t.Errorf("addRequest(%q, %q) error = %v, want %v", tt.track, tt.requester, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !got.same(tt.want) {
+			t.Errorf("addRequest(%q, %q) = %v, want %v", tt.track, tt.requester, got, tt.want)
+		}
+		if got.Fields["requested"] != "1" || got.Fields["requester"] != tt.requester {
+			t.Errorf("addRequest(%q, %q) fields = %v", tt.track, tt.requester, got.Fields)
+		}
+	}
+
+	requests := p.Requests()
+	if len(requests) != 2 || requests[0].File != a || requests[1].Fields["title"] != "Two" {
+		t.Errorf("Requests() = %v", requests)
+	}
+	if e, ok := p.popRequest(); !ok || e.File != a {
+		t.Errorf("popRequest() = %v, %v, want %s", e, ok, a)
+	}
+}
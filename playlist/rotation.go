@@ -0,0 +1,185 @@
+package playlist
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stunndard/goicy/config"
+	"github.com/stunndard/goicy/logger"
+)
+
+// playlist type of the rotation
+const typeRotation = "rotation"
+
+// category is a list of tracks of the rotation, like currents or jingles
+type category struct {
+	config.Category
+	entries []Entry
+	bag     bag
+	next    int // next entry in sequential order
+	last    Entry
+	loaded  []Entry // tracks read ahead by loadCategories
+}
+
+// rotation plays the categories in the order of the clock of the hour.
+// A clock is a comma separated list of slots, a slot is a category
+// or several ones separated by '|', one of them is picked by weight.
+type rotation struct {
+	categories map[string]*category
+	clocks     [24][][]*category
+	hour       int
+	pos        int // next slot of the clock
+}
+
+// builds the rotation from the config, the category tracks are loaded
+// when they are needed
+func (p *Playlist) loadRotation() error {
+	if p.rot != nil {
+		return nil
+	}
+	r := &rotation{categories: make(map[string]*category), hour: -1}
+	for _, c := range p.cfg.Categories {
+		if c.Playlist == "" {
+			return errors.New("No playlist for category " + c.Name)
+		}
+		r.categories[strings.ToLower(c.Name)] = &category{Category: c}
+	}
+
+	for h, clock := range p.cfg.Clocks {
+		for _, s := range strings.Split(clock, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			var slot []*category
+			for _, name := range strings.Split(s, "|") {
+				c, ok := r.categories[strings.ToLower(strings.TrimSpace(name))]
+				if !ok {
+					return errors.New("Unknown category in clock of hour " + strconv.Itoa(h) + ": " + name)
+				}
+				slot = append(slot, c)
+			}
+			r.clocks[h] = append(r.clocks[h], slot)
+		}
+		if len(r.clocks[h]) == 0 {
+			return errors.New("No clock for hour " + strconv.Itoa(h))
+		}
+	}
+	p.rot = r
+	return nil
+}
+
+// whether the tracks of the category have to be loaded before the next
+// pick, again when all of them were played
+func (c *category) exhausted() bool {
+	return c.entries == nil || (c.Random && c.bag.done(c.entries)) || (!c.Random && c.next >= len(c.entries))
+}
+
+// reads the tracks of the categories that have to be loaded before the
+// next pick. The files are read without holding the lock.
+func (p *Playlist) loadCategories() {
+	p.mu.Lock()
+	var exhausted []*category
+	if p.rot != nil {
+		for _, c := range p.rot.categories {
+			if c.exhausted() {
+				exhausted = append(exhausted, c)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	loaded := make(map[*category][]Entry)
+	for _, c := range exhausted {
+		loaded[c] = p.readCategory(c)
+	}
+
+	p.mu.Lock()
+	for c, entries := range loaded {
+		c.loaded = entries
+	}
+	p.mu.Unlock()
+}
+
+// reads the tracks of the category, it doesn't change the playlist
+// and is called without holding the lock
+func (p *Playlist) readCategory(c *category) []Entry {
+	var entries []Entry
+	var err error
+	if isDir(c.Playlist) {
+		entries = p.scanDir(c.Playlist)
+	} else {
+		entries, err = loadFile(c.Playlist, "")
+	}
+	if err != nil {
+		logger.Log("Cannot load category "+c.Name+": "+err.Error(), logger.LOG_ERROR)
+	}
+	p.readArtists(entries)
+	return entries
+}
+
+// returns the next track of the category
+func (p *Playlist) pickCategory(c *category) (Entry, bool) {
+	if c.exhausted() {
+		c.entries, c.loaded = c.loaded, nil
+		c.next = 0
+	}
+	if len(c.entries) == 0 {
+		return Entry{}, false
+	}
+	if c.Random {
+		c.last = c.entries[p.pick(&c.bag, c.entries, c.last)]
+	} else {
+		c.last = c.entries[c.next]
+		c.next++
+	}
+	return c.last, true
+}
+
+// picks one of the categories at random by their weights
+func pickWeighted(slot []*category) *category {
+	total := 0
+	for _, c := range slot {
+		if c.Weight > 0 {
+			total += c.Weight
+		}
+	}
+	if total == 0 {
+		return slot[rand.Intn(len(slot))]
+	}
+	n := rand.Intn(total)
+	for _, c := range slot {
+		if c.Weight <= 0 {
+			continue
+		}
+		if n < c.Weight {
+			return c
+		}
+		n -= c.Weight
+	}
+	return slot[len(slot)-1]
+}
+
+// returns the track of the next slot of the clock, the clock starts
+// over every hour. The slots without tracks are skipped.
+func (p *Playlist) nextRotation() Entry {
+	r := p.rot
+	if h := time.Now().Hour(); h != r.hour {
+		r.hour, r.pos = h, 0
+		logger.Log("Starting clock of hour "+strconv.Itoa(h), logger.LOG_DEBUG)
+	}
+	clock := r.clocks[r.hour]
+	for i := 0; i < len(clock); i++ {
+		slot := clock[r.pos%len(clock)]
+		r.pos++
+		c := pickWeighted(slot)
+		if e, ok := p.pickCategory(c); ok {
+			logger.Log("Rotation: "+c.Name+": "+e.String(), logger.LOG_DEBUG)
+			return e
+		}
+		logger.Log("Category "+c.Name+" has no tracks", logger.LOG_ERROR)
+	}
+	return Entry{}
+}
@@ -0,0 +1,59 @@
+package playlist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stunndard/goicy/config"
+)
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	music := filepath.Join(dir, "music")
+	jingles := filepath.Join(dir, "jingles")
+	for _, name := range []string{filepath.Join(music, "1.mp3"), filepath.Join(music, "2.mp3"), filepath.Join(jingles, "j.mp3")} {
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := config.Config{
+		StreamType:   "file",
+		StreamFormat: "mpeg",
+		Categories: []config.Category{
+			{Name: "music", Playlist: music},
+			{Name: "jingle", Playlist: jingles},
+		},
+	}
+	for h := range cfg.Clocks {
+		cfg.Clocks[h] = "music, jingle"
+	}
+	p := New(&cfg)
+	if err := p.loadRotation(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"music/1.mp3", "jingles/j.mp3", "music/2.mp3", "jingles/j.mp3",
+		// the categories are read again once all their tracks were played
+		"music/1.mp3", "jingles/j.mp3", "music/2.mp3", "jingles/j.mp3", "music/3.mp3"}
+	for i, w := range want {
+		if i == 4 {
+			// added after the first round
+			if err := ioutil.WriteFile(filepath.Join(music, "3.mp3"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var e Entry
+		if i == 0 {
+			e = p.First()
+		} else {
+			e = p.Next()
+		}
+		if e.File != filepath.Join(dir, filepath.FromSlash(w)) {
+			t.Errorf("track %d = %s, want %s", i, e.File, w)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package playlist
+
+import (
+	"time"
+
+	"github.com/stunndard/goicy/config"
+	"github.com/stunndard/goicy/logger"
+)
+
+// returns the playlist file and type of the show on air
+func (p *Playlist) current() (string, string) {
+	if p.active != nil {
+		return p.active.Playlist, p.active.PlaylistType
+	}
+	return p.cfg.Playlist, p.cfg.PlaylistType
+}
+
+// returns the time of the day of t at the clock time, built from the
+// hours and minutes so it's right on the daylight saving change days
+func clockOn(clock time.Duration, t time.Time) time.Time {
+	y, m, d := t.Date()
+	h := int(clock / time.Hour)
+	min := int(clock % time.Hour / time.Minute)
+	return time.Date(y, m, d, h, min, 0, 0, t.Location())
+}
+
+// returns the start of the show on the day of t
+func startOn(show *config.Show, t time.Time) time.Time {
+	return clockOn(show.Start, t)
+}
+
+// returns the end of the show started on the day of t, it's the next
+// day if the end is not after the start
+func endOn(show *config.Show, t time.Time) time.Time {
+	if show.End > show.Start {
+		return clockOn(show.End, t)
+	}
+	return clockOn(show.End, t.AddDate(0, 0, 1))
+}
+
+// returns the show on air at t, the first one in the config if they
+// overlap, or nil if there is none
+func (p *Playlist) onAir(t time.Time) *config.Show {
+	for i := range p.cfg.Schedule {
+		show := &p.cfg.Schedule[i]
+		// the show could start the day before
+		for d := 0; d >= -1; d-- {
+			day := t.AddDate(0, 0, d)
+			if !show.Days[day.Weekday()] {
+				continue
+			}
+			if !t.Before(startOn(show, day)) && t.Before(endOn(show, day)) {
+				return show
+			}
+		}
+	}
+	return nil
+}
+
+// NextChange returns the time the next show starts or the one on air
+// ends after t, zero time if there is no schedule
+func (p *Playlist) NextChange(t time.Time) time.Time {
+	var next time.Time
+	for i := range p.cfg.Schedule {
+		show := &p.cfg.Schedule[i]
+		for d := -1; d <= 7; d++ {
+			day := t.AddDate(0, 0, d)
+			if !show.Days[day.Weekday()] {
+				continue
+			}
+			for _, c := range []time.Time{startOn(show, day), endOn(show, day)} {
+				if c.After(t) && (next.IsZero() || c.Before(next)) {
+					next = c
+				}
+			}
+		}
+	}
+	return next
+}
+
+// switches to the show on air at t, returns true if it's another one
+func (p *Playlist) switchShow(t time.Time) bool {
+	show := p.onAir(t)
+	if show == p.active {
+		return false
+	}
+	if show != nil {
+		logger.Log("Scheduled playlist "+show.Name+" is on air", logger.LOG_INFO)
+	} else {
+		logger.Log("Scheduled playlist "+p.active.Name+" ended", logger.LOG_INFO)
+	}
+	p.active = show
+
+	// the new playlist starts from its beginning
+	p.mu.Lock()
+	p.idx = 0
+	p.np = Entry{}
+	p.shuffled = bag{}
+	p.rot = nil
+	p.mu.Unlock()
+	return true
+}
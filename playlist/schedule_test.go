@@ -0,0 +1,128 @@
+package playlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stunndard/goicy/config"
+)
+
+func scheduleConfig() *config.Config {
+	weekdays := [7]bool{false, true, true, true, true, true, false}
+	friday := [7]bool{time.Friday: true}
+	daily := [7]bool{true, true, true, true, true, true, true}
+	return &config.Config{Schedule: []config.Show{
+		{Name: "morning", Days: weekdays, Start: 8 * time.Hour, End: 10 * time.Hour},
+		{Name: "night", Days: friday, Start: 22 * time.Hour, End: 2 * time.Hour},
+		{Name: "overlap", Days: daily, Start: 9 * time.Hour, End: 9*time.Hour + 30*time.Minute},
+	}}
+}
+
+// the time on the day of January 2024, the 1st is a Monday
+func at(day, hour, min int) time.Time {
+	return time.Date(2024, time.January, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestOnAir(t *testing.T) {
+	p := New(scheduleConfig())
+	tests := []struct {
+		t    time.Time
+		want string // show name, empty for none
+	}{
+		{at(1, 7, 59), ""},
+		{at(1, 8, 0), "morning"},
+		{at(1, 9, 15), "morning"},
+		{at(1, 10, 0), ""},
+		{at(6, 8, 30), ""},
+		{at(6, 9, 15), "overlap"},
+		{at(5, 1, 0), ""},
+		{at(5, 23, 0), "night"},
+		{at(6, 1, 59), "night"},
+		{at(6, 2, 0), ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if show := p.onAir(tt.t); show != nil {
+			got = show.Name
+		}
+		if got != tt.want {
+			t.Errorf("onAir(%v) = %q, want %q", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestNextChange(t *testing.T) {
+	p := New(scheduleConfig())
+	tests := []struct {
+		t, want time.Time
+	}{
+		{at(1, 7, 0), at(1, 8, 0)},
+		{at(1, 8, 0), at(1, 9, 0)},
+		{at(1, 9, 15), at(1, 9, 30)},
+		{at(1, 9, 30), at(1, 10, 0)},
+		{at(1, 10, 0), at(2, 8, 0)},
+		{at(5, 10, 0), at(5, 22, 0)},
+		{at(5, 23, 0), at(6, 2, 0)},
+		{at(6, 2, 0), at(6, 9, 0)},
+	}
+	for _, tt := range tests {
+		if got := p.NextChange(tt.t); !got.Equal(tt.want) {
+			t.Errorf("NextChange(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+
+	if got := New(&config.Config{}).NextChange(at(1, 0, 0)); !got.IsZero() {
+		t.Errorf("NextChange() without a schedule = %v, want zero time", got)
+	}
+}
+
+func TestSwitchShow(t *testing.T) {
+	p := New(scheduleConfig())
+	// the show is switched at the given time, not the current one
+	if !p.switchShow(at(5, 22, 0)) || p.active == nil || p.active.Name != "night" {
+		t.Errorf("switchShow() at the show start didn't switch to it")
+	}
+	if p.switchShow(at(5, 23, 0)) {
+		t.Errorf("switchShow() during the same show switched")
+	}
+	if !p.switchShow(at(6, 2, 0)) || p.active != nil {
+		t.Errorf("switchShow() at the show end didn't end it")
+	}
+}
+
+func TestScheduleDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data: ", err)
+	}
+	daily := [7]bool{true, true, true, true, true, true, true}
+	cfg := &config.Config{Schedule: []config.Show{
+		{Name: "night", Days: daily, Start: 1 * time.Hour, End: 4 * time.Hour},
+		{Name: "morning", Days: daily, Start: 6 * time.Hour, End: 8 * time.Hour},
+	}}
+	p := New(cfg)
+	// the clocks go forward at 2:00 on March 31 and back at 3:00 on October 27 2024
+	local := func(m time.Month, d, h, min int) time.Time {
+		return time.Date(2024, m, d, h, min, 0, 0, loc)
+	}
+	tests := []struct {
+		t, want time.Time
+	}{
+		{local(time.March, 31, 0, 30), local(time.March, 31, 1, 0)},
+		{local(time.March, 31, 1, 30), local(time.March, 31, 4, 0)},
+		{local(time.March, 31, 4, 0), local(time.March, 31, 6, 0)},
+		{local(time.October, 27, 1, 30), local(time.October, 27, 4, 0)},
+		{local(time.October, 27, 4, 0), local(time.October, 27, 6, 0)},
+	}
+	for _, tt := range tests {
+		if got := p.NextChange(tt.t); !got.Equal(tt.want) {
+			t.Errorf("NextChange(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+	if show := p.onAir(local(time.March, 31, 5, 30)); show != nil {
+		t.Errorf("onAir() at 5:30 on the DST day = %s, want none", show.Name)
+	}
+	if show := p.onAir(local(time.March, 31, 6, 0)); show == nil || show.Name != "morning" {
+		t.Errorf("onAir() at 6:00 on the DST day isn't the morning show")
+	}
+}
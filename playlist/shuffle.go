@@ -0,0 +1,134 @@
+package playlist
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/metadata"
+)
+
+// bag is the shuffle state of a list of entries
+type bag struct {
+	played map[string]bool // entries played in the current cycle
+}
+
+func (e Entry) key() string {
+	return e.File + "@" + e.Start.String()
+}
+
+// reads the artists of the entries from the file tags when they are
+// loaded, so the tags are not read under the lock when they are picked
+func (p *Playlist) readArtists(entries []Entry) {
+	if p.cfg.ArtistGap <= 0 {
+		return
+	}
+	for _, e := range entries {
+		if e.Fields["artist"] != "" {
+			continue
+		}
+		p.mu.Lock()
+		_, ok := p.artists[e.File]
+		p.mu.Unlock()
+		if ok {
+			continue
+		}
+		a := ""
+		if tags, err := metadata.ReadTags(e.File); err == nil {
+			a = tags.Get("artist")
+		}
+		p.mu.Lock()
+		p.artists[e.File] = a
+		p.mu.Unlock()
+	}
+}
+
+// returns the artist of the entry from its fields or the file tags
+// read by readArtists
+func (p *Playlist) artistOf(e Entry) string {
+	artist := e.Fields["artist"]
+	if artist == "" {
+		artist = p.artists[e.File]
+	}
+	if artist == "" {
+		artist = e.Fallback["artist"]
+	}
+	return strings.ToLower(strings.TrimSpace(artist))
+}
+
+// whether the artist was played within the last artistgap entries
+func (p *Playlist) recentArtist(artist string) bool {
+	if artist == "" {
+		return false
+	}
+	for _, a := range p.recent {
+		if a == artist {
+			return true
+		}
+	}
+	return false
+}
+
+// marks the entry as played in the current shuffle cycle
+func (p *Playlist) mark(b *bag, e Entry) {
+	if b.played == nil {
+		b.played = make(map[string]bool)
+	}
+	b.played[e.key()] = true
+	gap := p.cfg.ArtistGap
+	if gap <= 0 {
+		p.recent = nil
+		return
+	}
+	p.recent = append(p.recent, p.artistOf(e))
+	if len(p.recent) > gap {
+		p.recent = p.recent[len(p.recent)-gap:]
+	}
+}
+
+// whether all the entries were played in the current cycle
+func (b *bag) done(entries []Entry) bool {
+	for _, e := range entries {
+		if !b.played[e.key()] {
+			return false
+		}
+	}
+	return true
+}
+
+// picks the next entry to play at random, every entry is played once
+// per cycle. The artists played within the last artistgap entries are
+// avoided unless there are only them left in the cycle.
+func (p *Playlist) pick(b *bag, entries []Entry, last Entry) int {
+	var unplayed []int
+	for i, e := range entries {
+		if !b.played[e.key()] {
+			unplayed = append(unplayed, i)
+		}
+	}
+	if len(unplayed) == 0 {
+		// new cycle, the last entry is not repeated at once
+		logger.Log("All playlist entries played, reshuffling", logger.LOG_DEBUG)
+		b.played = nil
+		for i, e := range entries {
+			if !e.same(last) || len(entries) == 1 {
+				unplayed = append(unplayed, i)
+			}
+		}
+	}
+
+	pick := -1
+	for _, n := range rand.Perm(len(unplayed)) {
+		i := unplayed[n]
+		if p.cfg.ArtistGap <= 0 || !p.recentArtist(p.artistOf(entries[i])) {
+			pick = i
+			break
+		}
+	}
+	if pick < 0 {
+		logger.Log("No entry left with another artist, artistgap ignored", logger.LOG_DEBUG)
+		pick = unplayed[rand.Intn(len(unplayed))]
+	}
+	p.mark(b, entries[pick])
+	return pick
+}
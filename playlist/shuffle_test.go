@@ -0,0 +1,104 @@
+package playlist
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stunndard/goicy/config"
+)
+
+func artistEntries(artists ...string) []Entry {
+	var entries []Entry
+	for i, a := range artists {
+		entries = append(entries, Entry{
+			File:   "album.flac",
+			Start:  time.Duration(i) * time.Minute,
+			Fields: map[string]string{"artist": a},
+		})
+	}
+	return entries
+}
+
+func TestPick(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []Entry
+		gap     int
+		apart   bool // no artist is played twice in a row
+	}{
+		{"single entry", artistEntries("A"), 0, false},
+		{"no artistgap", artistEntries("A", "A", "B", "C", "D"), 0, false},
+		{"artistgap", artistEntries("A", "A", "B", "B"), 1, true},
+		{"artistgap case", artistEntries("A", "a ", "B", "b"), 1, true},
+		{"artistgap can't be kept", artistEntries("A", "A", "A", "B"), 1, false},
+		{"artistgap longer than the list", artistEntries("A", "B", "C"), 5, false},
+	}
+	for _, tt := range tests {
+		cfg := config.Config{ArtistGap: tt.gap}
+		p := New(&cfg)
+		var b bag
+		last := Entry{}
+		for cycle := 0; cycle < 20; cycle++ {
+			played := make(map[int]bool)
+			for range tt.entries {
+				i := p.pick(&b, tt.entries, last)
+				e := tt.entries[i]
+				if played[i] {
+					t.Errorf("pick(%s) played entry %d twice in cycle %d", tt.name, i, cycle)
+				}
+				played[i] = true
+				if len(tt.entries) > 1 && e.same(last) {
+					t.Errorf("pick(%s) repeated entry %d at once in cycle %d", tt.name, i, cycle)
+				}
+				if tt.apart && last.File != "" && p.artistOf(e) == p.artistOf(last) {
+					t.Errorf("pick(%s) played artist %q twice in a row in cycle %d", tt.name, p.artistOf(e), cycle)
+				}
+				last = e
+			}
+		}
+	}
+}
+
+// writes a file with an ID3v1 tag with the artist
+func taggedFile(t *testing.T, name, artist string) {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[33:63], artist)
+	tag[127] = 255
+	if err := ioutil.WriteFile(name, append(make([]byte, 100), tag...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadArtists(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.mp3"), filepath.Join(dir, "b.mp3")
+	taggedFile(t, a, "One")
+	taggedFile(t, b, "Two")
+	entries := []Entry{
+		{File: a},
+		{File: b, Fallback: map[string]string{"artist": "Fallback"}},
+		{File: filepath.Join(dir, "missing.mp3"), Fallback: map[string]string{"artist": "Fallback"}},
+		{File: a, Start: time.Minute, Fields: map[string]string{"artist": "Cue"}},
+	}
+	tests := []struct {
+		gap  int
+		want []string
+	}{
+		{1, []string{"one", "two", "fallback", "cue"}},
+		// the tags are read only for artistgap
+		{0, []string{"", "fallback", "fallback", "cue"}},
+	}
+	for _, tt := range tests {
+		cfg := config.Config{ArtistGap: tt.gap}
+		p := New(&cfg)
+		p.readArtists(entries)
+		for i, e := range entries {
+			if got := p.artistOf(e); got != tt.want[i] {
+				t.Errorf("artistOf(%s) with artistgap %d = %q, want %q", e.File, tt.gap, got, tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package script
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/playlist"
+	"github.com/stunndard/goicy/util"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Script is a Lua script with the functions called by goicy:
+//
+//	next_track()           returns the next file name, or a table with
+//	                       file, start and end in seconds and metadata fields
+//	on_track_start(info)   called when a track starts, info has file, filename,
+//	                       name and the metadata fields of the playlist entry
+//	format_metadata(tags)  returns the song title, the metadataformat
+//	                       template is used if it returns nil or ""
+//
+// Every function is optional except next_track for Lua playlists.
+// Scripts can call log(message) to write to the goicy log.
+type Script struct {
+	mu sync.Mutex
+	L  *lua.LState
+}
+
+// Load runs the script file, its functions can be called then
+func Load(filename string) (*Script, error) {
+	if !util.FileExists(filename) {
+		return nil, errors.New("Script file doesn't exist: " + filename)
+	}
+	L := lua.NewState()
+	L.SetGlobal("log", L.NewFunction(func(L *lua.LState) int {
+		logger.Log("Script: "+L.CheckString(1), logger.LOG_INFO)
+		return 0
+	}))
+	if err := L.DoFile(filename); err != nil {
+		L.Close()
+		return nil, err
+	}
+	logger.Log("Loaded script: "+filename, logger.LOG_INFO)
+	return &Script{L: L}, nil
+}
+
+// Close frees the interpreter
+func (s *Script) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.L.Close()
+}
+
+// Has returns whether the script defines the function
+func (s *Script) Has(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.L.GetGlobal(name).Type() == lua.LTFunction
+}
+
+// calls the function with the arguments, returns its result or nil
+// if the function isn't defined
+func (s *Script) call(name string, args ...lua.LValue) (lua.LValue, error) {
+	fn := s.L.GetGlobal(name)
+	if fn.Type() != lua.LTFunction {
+		return nil, nil
+	}
+	if err := s.L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...); err != nil {
+		return nil, err
+	}
+	ret := s.L.Get(-1)
+	s.L.Pop(1)
+	return ret, nil
+}
+
+func (s *Script) table(fields map[string]string) *lua.LTable {
+	t := s.L.NewTable()
+	for k, v := range fields {
+		t.RawSetString(k, lua.LString(v))
+	}
+	return t
+}
+
+// NextTrack calls next_track() and returns the playlist entry
+func (s *Script) NextTrack() (playlist.Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret, err := s.call("next_track")
+	if err != nil {
+		return playlist.Entry{}, err
+	}
+
+	switch v := ret.(type) {
+	case lua.LString:
+		return playlist.Entry{File: string(v)}, nil
+	case *lua.LTable:
+		var e playlist.Entry
+		v.ForEach(func(key, value lua.LValue) {
+			k, ok := key.(lua.LString)
+			if !ok {
+				return
+			}
+			switch string(k) {
+			case "file":
+				e.File = value.String()
+			case "start":
+				e.Start = seconds(value)
+			case "end":
+				e.End = seconds(value)
+			default:
+				if e.Fields == nil {
+					e.Fields = make(map[string]string)
+				}
+				e.Fields[string(k)] = value.String()
+			}
+		})
+		if e.File == "" {
+			return e, errors.New("next_track() returned a table without file")
+		}
+		return e, nil
+	}
+	return playlist.Entry{}, errors.New("next_track() returned no track")
+}
+
+func seconds(v lua.LValue) time.Duration {
+	if n, ok := v.(lua.LNumber); ok {
+		return time.Duration(float64(n) * float64(time.Second))
+	}
+	return 0
+}
+
+// OnTrackStart calls on_track_start(info)
+func (s *Script) OnTrackStart(info map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.call("on_track_start", s.table(info))
+	return err
+}
+
+// FormatMetadata calls format_metadata(tags), ok is false if the
+// function isn't defined or returned nothing
+func (s *Script) FormatMetadata(tags map[string]string) (md string, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret, err := s.call("format_metadata", s.table(tags))
+	if err != nil || ret == nil || ret == lua.LNil {
+		return "", false, err
+	}
+	md = ret.String()
+	return md, md != "", nil
+}
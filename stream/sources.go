@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"errors"
+
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/network"
+)
+
+// connects all sources in parallel, returns once one of them is
+// connected or all of them failed. The others go on connecting in
+// background and get the stream from the start of the track, so a dead
+// server doesn't hold the stream.
+func connectAll(sources []*network.Source, br float64, sr, ch int) error {
+	results := make(chan error, len(sources))
+	for _, src := range sources {
+		go func(src *network.Source) {
+			err := src.Connect(br, sr, ch)
+			if err != nil && !network.IsRetryLater(err) {
+				logger.Log("["+src.Name()+"] Cannot connect to server: "+err.Error(), logger.LOG_ERROR)
+			}
+			results <- err
+		}(src)
+	}
+
+	var res error
+	for range sources {
+		err := <-results
+		if err == nil {
+			return nil
+		}
+		res = err
+	}
+	if res == nil {
+		res = errors.New("No servers connected")
+	}
+	return res
+}
+
+// sends buf to every source, disconnected ones are
+// reconnected in background by the source itself
+func sendAll(sources []*network.Source, buf []byte) error {
+	for _, src := range sources {
+		src.Write(buf)
+	}
+	if !anyConnected(sources) {
+		return errors.New("Lost connection to all servers")
+	}
+	return nil
+}
+
+func anyConnected(sources []*network.Source) bool {
+	for _, src := range sources {
+		if src.Connected() {
+			return true
+		}
+	}
+	return false
+}
+
+func closeAll(sources []*network.Source) {
+	for _, src := range sources {
+		src.Close()
+	}
+}
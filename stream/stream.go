@@ -2,53 +2,101 @@ package stream
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"net"
 	"os"
 	"os/exec"
 	"strconv"
 	"time"
 
 	"github.com/stunndard/goicy/aac"
-	"github.com/stunndard/goicy/config"
 	"github.com/stunndard/goicy/cuesheet"
+	"github.com/stunndard/goicy/flac"
 	"github.com/stunndard/goicy/logger"
-	"github.com/stunndard/goicy/metadata"
 	"github.com/stunndard/goicy/mpeg"
-	"github.com/stunndard/goicy/network"
+	"github.com/stunndard/goicy/ogg"
+	"github.com/stunndard/goicy/playlist"
 	"github.com/stunndard/goicy/util"
 )
 
-var totalFramesSent uint64
-var totalTimeBegin time.Time
-var Abort bool
+// StreamFile streams AAC, MPEG, Ogg or FLAC file as is to the sources
+func (s *Streamer) StreamFile(ctx context.Context, filename string) error {
+	return s.streamFile(ctx, playlist.Entry{File: filename}, 0)
+}
 
-func StreamFile(filename string) error {
+// streams the playlist entry from offset, only its part is sent for
+// cuesheet tracks. The offset is from the start of the entry.
+func (s *Streamer) streamFile(ctx context.Context, entry playlist.Entry, offset time.Duration) error {
+	filename := entry.File
 	var (
 		br                  float64
 		spf, sr, frames, ch int
-		sock                net.Conn
 	)
 
+	var oggReader *ogg.Reader
+	var flacReader *flac.Reader
+	var mp4Reader *aac.MP4Reader
+
+	// ends the Ogg streams of the track, on every exit
+	// as the track can be stopped before its last page
+	finish := func() {
+		var buf []byte
+		switch {
+		case flacReader != nil:
+			buf = flacReader.Finish()
+		case oggReader != nil:
+			buf = oggReader.Finish()
+		}
+		if buf != nil {
+			sendAll(s.sources, buf)
+		}
+	}
+
 	cleanUp := func(err error) {
-		network.Close(sock)
-		//totalFramesSent = 0
+		finish()
+		closeAll(s.sources)
+		//s.totalFramesSent = 0
 	}
 
-	logger.Log("Checking file: "+filename+"...", logger.LOG_INFO)
+	logger.Log("Checking file: "+entry.String()+"...", logger.LOG_INFO)
 
 	var err error
-	if config.Cfg.StreamFormat == "mpeg" {
+	switch s.cfg.StreamFormat {
+	case "mpeg":
 		err = mpeg.GetFileInfo(filename, &br, &spf, &sr, &frames, &ch)
-	} else {
+	case "ogg", "vorbis", "opus":
+		err = ogg.GetFileInfo(filename, &br, &spf, &sr, &frames, &ch)
+	case "flac":
+		err = flac.GetFileInfo(filename, &br, &spf, &sr, &frames, &ch)
+	default:
 		err = aac.GetFileInfo(filename, &br, &spf, &sr, &frames, &ch)
 	}
 	if err != nil {
 		return err
 	}
 
-	sock, err = network.ConnectServer(config.Cfg.Host, config.Cfg.Port, br, sr, ch)
-	if err != nil {
+	// frames of the track part of the file
+	first, last := 0, frames
+	if entry.IsPart() || offset > 0 {
+		first = int((entry.Start + offset).Seconds() * float64(sr) / float64(spf))
+		if entry.End > 0 && int(entry.End.Seconds()*float64(sr)/float64(spf)) < last {
+			last = int(entry.End.Seconds() * float64(sr) / float64(spf))
+		}
+		if first >= last {
+			err := new(util.FileError)
+			err.Msg = "Track is out of the file: " + entry.String()
+			return err
+		}
+		switch s.cfg.StreamFormat {
+		case "ogg", "vorbis", "opus":
+			err := new(util.FileError)
+			err.Msg = "Cuesheet tracks are not supported for Ogg files: " + filename
+			return err
+		}
+		frames = last - first
+	}
+
+	if err := connectAll(s.sources, br, sr, ch); err != nil {
 		logger.Log("Cannot connect to server", logger.LOG_ERROR)
 		return err
 	}
@@ -61,18 +109,68 @@ func StreamFile(filename string) error {
 
 	defer f.Close()
 
-	if config.Cfg.StreamFormat == "mpeg" {
+	switch s.cfg.StreamFormat {
+	case "mpeg":
 		mpeg.SeekTo1StFrame(*f)
-	} else {
-		aac.SeekTo1StFrame(*f)
+	case "ogg", "vorbis", "opus":
+		// ogg and flac are paced by samples, spf is 1
+		oggReader = ogg.NewReader(f)
+	case "flac":
+		if flacReader, err = flac.NewReader(f); err != nil {
+			cleanUp(err)
+			return err
+		}
+	default:
+		if !aac.IsMP4(f) {
+			aac.SeekTo1StFrame(*f)
+			break
+		}
+		// AAC samples from MP4 are sent as ADTS frames
+		if mp4Reader, err = aac.NewMP4Reader(f); err != nil {
+			cleanUp(err)
+			return err
+		}
 	}
 
-	logger.Log("Streaming file: "+filename+"...", logger.LOG_INFO)
+	// skip to the first frame of the track
+	if first > 0 {
+		logger.Log("Seeking to frame "+strconv.Itoa(first)+"...", logger.LOG_DEBUG)
+		switch {
+		case flacReader != nil:
+			err = flacReader.Skip(int64(first))
+		case mp4Reader != nil:
+			mp4Reader.Seek(first)
+		default:
+			for skipped := 0; skipped < first && err == nil; skipped += 1000 {
+				n := 1000
+				if first-skipped < n {
+					n = first - skipped
+				}
+				if s.cfg.StreamFormat == "mpeg" {
+					_, err = mpeg.GetFrames(*f, n)
+				} else {
+					_, err = aac.GetFrames(*f, n)
+				}
+			}
+		}
+		if err != nil {
+			cleanUp(err)
+			return err
+		}
+	}
 
-	cuefile := util.Basename(filename) + ".cue"
-	if config.Cfg.UpdateMetadata {
-		go metadata.GetTagsFFMPEG(filename)
-		cuesheet.Load(cuefile)
+	logger.Log("Streaming file: "+entry.String()+"...", logger.LOG_INFO)
+
+	var cue *cuesheet.CueSheet
+	var cueTrack *cuesheet.Track
+	s.startTrack(entry)
+	s.saveNowPlaying(offset, true)
+	if s.tagMetadata() {
+		s.sendTags(entry)
+		// the track of a cuesheet in the playlist has its own fields
+		if !entry.IsPart() {
+			cue = cuesheet.Load(util.Basename(filename) + ".cue")
+		}
 	}
 
 	logger.TermLn("CTRL-C to stop", logger.LOG_INFO)
@@ -86,11 +184,24 @@ func StreamFile(filename string) error {
 	for framesSent < frames {
 		sendBegin := time.Now()
 
+		// don't read past the end of the track, trimmed frames are not sent
+		n := framesToRead
+		if frames-framesSent < n {
+			n = frames - framesSent
+		}
+
 		var lbuf []byte
-		if config.Cfg.StreamFormat == "mpeg" {
-			lbuf, err = mpeg.GetFrames(*f, framesToRead)
-		} else {
-			lbuf, err = aac.GetFrames(*f, framesToRead)
+		switch {
+		case s.cfg.StreamFormat == "mpeg":
+			lbuf, err = mpeg.GetFrames(*f, n)
+		case oggReader != nil:
+			lbuf, err = oggReader.ReadSamples(n)
+		case flacReader != nil:
+			lbuf, err = flacReader.ReadSamples(n)
+		case mp4Reader != nil:
+			lbuf, err = mp4Reader.GetFrames(n)
+		default:
+			lbuf, err = aac.GetFrames(*f, n)
 		}
 		if err != nil {
 			logger.Log("Error reading data stream", logger.LOG_ERROR)
@@ -98,13 +209,13 @@ func StreamFile(filename string) error {
 			return err
 		}
 
-		if err := network.Send(sock, lbuf); err != nil {
+		if err := sendAll(s.sources, lbuf); err != nil {
 			cleanUp(err)
 			logger.Log("Error sending data stream", logger.LOG_ERROR)
 			return err
 		}
 
-		framesSent = framesSent + framesToRead
+		framesSent = framesSent + n
 
 		timeElapsed := int(float64((time.Now().Sub(timeBegin)).Seconds()) * 1000)
 		timeSent := int(float64(framesSent) * float64(spf) / float64(sr) * 1000)
@@ -114,8 +225,19 @@ func StreamFile(filename string) error {
 			bufferSent = timeSent - timeElapsed
 		}
 
-		if config.Cfg.UpdateMetadata {
-			cuesheet.Update(uint32(timeElapsed))
+		// the position in the entry, the cuesheet positions are in the whole file
+		pos := offset + time.Duration(timeElapsed)*time.Millisecond
+		s.saveNowPlaying(pos, false)
+
+		if s.tagMetadata() {
+			if t := cue.TrackAt(filename, pos); t != nil && t != cueTrack {
+				cueTrack = t
+				s.sendCueMetadata(cue, t)
+			}
+		}
+
+		if s.cutIn(time.Duration(bufferSent) * time.Millisecond) {
+			break
 		}
 
 		// calculate the send lag
@@ -124,72 +246,86 @@ func StreamFile(filename string) error {
 		if timeElapsed > 1500 {
 			logger.Term("Frames: "+strconv.Itoa(framesSent)+"/"+strconv.Itoa(frames)+"  Time: "+
 				strconv.Itoa(timeElapsed/1000)+"/"+strconv.Itoa(timeSent/1000)+"s  Buffer: "+
-				strconv.Itoa(bufferSent)+"ms  Frames/Bytes: "+strconv.Itoa(framesToRead)+"/"+strconv.Itoa(len(lbuf)), logger.LOG_INFO)
+				strconv.Itoa(bufferSent)+"ms  Frames/Bytes: "+strconv.Itoa(n)+"/"+strconv.Itoa(len(lbuf)), logger.LOG_INFO)
 		}
 
 		// regulate sending rate
 		timePause := 0
-		if bufferSent < (config.Cfg.BufferSize - 100) {
+		if bufferSent < (s.cfg.BufferSize - 100) {
 			timePause = 900 - sendLag
 		} else {
-			if bufferSent > config.Cfg.BufferSize {
+			if bufferSent > s.cfg.BufferSize {
 				timePause = 1100 - sendLag
 			} else {
 				timePause = 975 - sendLag
 			}
 		}
 
-		if Abort {
-			err := errors.New("aborted by user")
+		if !sleep(ctx, time.Duration(time.Millisecond)*time.Duration(timePause)) {
+			err := ctx.Err()
 			cleanUp(err)
 			return err
 		}
-
-		time.Sleep(time.Duration(time.Millisecond) * time.Duration(timePause))
 	}
 
+	// the part or the cut track ends before the end of the file
+	finish()
+
 	// pause to clear up the buffer
-	timeBetweenTracks := int(((float64(frames)*float64(spf))/float64(sr))*1000) - int(float64((time.Now().Sub(timeBegin)).Seconds())*1000)
+	timeBetweenTracks := int(((float64(framesSent)*float64(spf))/float64(sr))*1000) - int(float64((time.Now().Sub(timeBegin)).Seconds())*1000)
 	logger.Log("Pausing for "+strconv.Itoa(timeBetweenTracks)+"ms...", logger.LOG_DEBUG)
-	time.Sleep(time.Duration(time.Millisecond) * time.Duration(timeBetweenTracks))
+	if !sleep(ctx, time.Duration(time.Millisecond)*time.Duration(timeBetweenTracks)) {
+		return ctx.Err()
+	}
 
 	return nil
 }
 
-func StreamFFMPEG(filename string) error {
+// StreamFFMPEG streams the file recoded by ffmpeg to the sources
+func (s *Streamer) StreamFFMPEG(ctx context.Context, filename string) error {
+	return s.streamFFMPEG(ctx, playlist.Entry{File: filename}, 0)
+}
+
+// streams the playlist entry recoded by ffmpeg, only its part
+// is decoded for cuesheet tracks
+func (s *Streamer) streamFFMPEG(ctx context.Context, entry playlist.Entry, offset time.Duration) error {
+	filename := entry.File
 	var (
-		sock net.Conn
-		res  error
-		cmd  *exec.Cmd
+		res error
+		cmd *exec.Cmd
 	)
 
 	cleanUp := func(err error) {
 		logger.Log("Killing ffmpeg..", logger.LOG_DEBUG)
 		cmd.Process.Kill()
-		network.Close(sock)
-		totalFramesSent = 0
+		closeAll(s.sources)
+		s.totalFramesSent = 0
 		res = err
 	}
 
+	switch s.cfg.StreamFormat {
+	case "ogg", "vorbis", "opus", "flac":
+		return errors.New("Ogg and FLAC formats are supported in file mode only")
+	}
+
 	var err error
-	sock, err = network.ConnectServer(config.Cfg.Host, config.Cfg.Port, 0, 0, 0)
-	if err != nil {
+	if err := connectAll(s.sources, 0, 0, 0); err != nil {
 		logger.Log("Cannot connect to server", logger.LOG_ERROR)
 		return err
 	}
 
 	cmdArgs := []string{}
 	profile := ""
-	if config.Cfg.StreamFormat == "mpeg" {
+	if s.cfg.StreamFormat == "mpeg" {
 		profile = "MPEG"
-		if config.Cfg.StreamReencode {
+		if s.cfg.StreamReencode {
 			cmdArgs = []string{
 				"-i", filename,
 				"-c:a", "libmp3lame",
-				"-b:a", strconv.Itoa(config.Cfg.StreamBitrate),
+				"-b:a", strconv.Itoa(s.cfg.StreamBitrate),
 				"-cutoff", "20000",
-				"-ar", strconv.Itoa(config.Cfg.StreamSamplerate),
-				"-ac", strconv.Itoa(config.Cfg.StreamChannels),
+				"-ar", strconv.Itoa(s.cfg.StreamSamplerate),
+				"-ac", strconv.Itoa(s.cfg.StreamChannels),
 				"-f", "mp3",
 				"-write_xing", "0",
 				"-id3v2_version", "0",
@@ -208,22 +344,22 @@ func StreamFFMPEG(filename string) error {
 			}
 		}
 	} else {
-		if config.Cfg.StreamAACProfile == "lc" {
+		if s.cfg.StreamAACProfile == "lc" {
 			profile = "aac_low"
-		} else if config.Cfg.StreamAACProfile == "he" {
+		} else if s.cfg.StreamAACProfile == "he" {
 			profile = "aac_he"
 		} else {
 			profile = "aac_he_v2"
 		}
-		if config.Cfg.StreamReencode {
+		if s.cfg.StreamReencode {
 			cmdArgs = []string{
 				"-i", filename,
 				"-c:a", "libfdk_aac",
 				"-profile:a", profile,
-				"-b:a", strconv.Itoa(config.Cfg.StreamBitrate),
+				"-b:a", strconv.Itoa(s.cfg.StreamBitrate),
 				"-cutoff", "20000",
-				"-ar", strconv.Itoa(config.Cfg.StreamSamplerate),
-				"-ac", strconv.Itoa(config.Cfg.StreamChannels),
+				"-ar", strconv.Itoa(s.cfg.StreamSamplerate),
+				"-ac", strconv.Itoa(s.cfg.StreamChannels),
 				"-f", "adts",
 				"-loglevel", "fatal",
 				"-",
@@ -239,16 +375,25 @@ func StreamFFMPEG(filename string) error {
 		}
 	}
 
-	logger.Log("Starting ffmpeg: "+config.Cfg.FFMPEGPath, logger.LOG_DEBUG)
-	if config.Cfg.StreamReencode {
+	// ffmpeg seeks to the track part itself
+	if entry.IsPart() || offset > 0 {
+		seek := []string{"-ss", ffmpegTime(entry.Start + offset)}
+		if entry.End > 0 {
+			seek = append(seek, "-to", ffmpegTime(entry.End))
+		}
+		cmdArgs = append(seek, cmdArgs...)
+	}
+
+	logger.Log("Starting ffmpeg: "+s.cfg.FFMPEGPath, logger.LOG_DEBUG)
+	if s.cfg.StreamReencode {
 		logger.Log("Format         : "+profile, logger.LOG_DEBUG)
-		logger.Log("Bitrate        : "+strconv.Itoa(config.Cfg.StreamBitrate), logger.LOG_DEBUG)
-		logger.Log("Samplerate     : "+strconv.Itoa(config.Cfg.StreamSamplerate), logger.LOG_DEBUG)
+		logger.Log("Bitrate        : "+strconv.Itoa(s.cfg.StreamBitrate), logger.LOG_DEBUG)
+		logger.Log("Samplerate     : "+strconv.Itoa(s.cfg.StreamSamplerate), logger.LOG_DEBUG)
 	} else {
 		logger.Log("Format        : source, no reencoding", logger.LOG_DEBUG)
 	}
 
-	cmd = exec.Command(config.Cfg.FFMPEGPath, cmdArgs...)
+	cmd = exec.Command(s.cfg.FFMPEGPath, cmdArgs...)
 
 	f, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
@@ -267,12 +412,17 @@ func StreamFFMPEG(filename string) error {
 		}
 	}()
 
-	logger.Log("Streaming file: "+filename+"...", logger.LOG_INFO)
+	logger.Log("Streaming file: "+entry.String()+"...", logger.LOG_INFO)
 
-	cuefile := util.Basename(filename) + ".cue"
-	if config.Cfg.UpdateMetadata {
-		go metadata.GetTagsFFMPEG(filename)
-		cuesheet.Load(cuefile)
+	var cue *cuesheet.CueSheet
+	var cueTrack *cuesheet.Track
+	s.startTrack(entry)
+	s.saveNowPlaying(offset, true)
+	if s.tagMetadata() {
+		s.sendTags(entry)
+		if !entry.IsPart() {
+			cue = cuesheet.Load(util.Basename(filename) + ".cue")
+		}
 	}
 
 	logger.TermLn("CTRL-C to stop", logger.LOG_INFO)
@@ -288,7 +438,7 @@ func StreamFFMPEG(filename string) error {
 		sendBegin := time.Now()
 
 		var lbuf []byte
-		if config.Cfg.StreamFormat == "mpeg" {
+		if s.cfg.StreamFormat == "mpeg" {
 			lbuf, err = mpeg.GetFramesStdin(f, framesToRead)
 			if framesToRead == 1 {
 				if len(lbuf) < 4 {
@@ -339,22 +489,22 @@ func StreamFFMPEG(filename string) error {
 			break
 		}
 
-		if totalFramesSent == 0 {
-			totalTimeBegin = time.Now()
+		if s.totalFramesSent == 0 {
+			s.totalTimeBegin = time.Now()
 			//stdoutFramesSent = 0
 		}
 
-		if err := network.Send(sock, lbuf); err != nil {
+		if err := sendAll(s.sources, lbuf); err != nil {
 			logger.Log("Error sending data stream", logger.LOG_ERROR)
 			cleanUp(err)
 			break
 		}
 
-		totalFramesSent = totalFramesSent + uint64(framesToRead)
+		s.totalFramesSent = s.totalFramesSent + uint64(framesToRead)
 		frames = frames + framesToRead
 
-		timeElapsed := int(float64((time.Now().Sub(totalTimeBegin)).Seconds()) * 1000)
-		timeSent := int(float64(totalFramesSent) * float64(spf) / float64(sr) * 1000)
+		timeElapsed := int(float64((time.Now().Sub(s.totalTimeBegin)).Seconds()) * 1000)
+		timeSent := int(float64(s.totalFramesSent) * float64(spf) / float64(sr) * 1000)
 		timeFileElapsed := int(float64((time.Now().Sub(timeFileBegin)).Seconds()) * 1000)
 
 		bufferSent := 0
@@ -362,15 +512,26 @@ func StreamFFMPEG(filename string) error {
 			bufferSent = timeSent - timeElapsed
 		}
 
-		if config.Cfg.UpdateMetadata {
-			cuesheet.Update(uint32(timeFileElapsed))
+		pos := offset + time.Duration(timeFileElapsed)*time.Millisecond
+		s.saveNowPlaying(pos, false)
+
+		if s.tagMetadata() {
+			if t := cue.TrackAt(filename, pos); t != nil && t != cueTrack {
+				cueTrack = t
+				s.sendCueMetadata(cue, t)
+			}
+		}
+
+		if s.cutIn(time.Duration(bufferSent) * time.Millisecond) {
+			cmd.Process.Kill()
+			break
 		}
 
 		// calculate the send lag
 		sendLag := int(float64((time.Now().Sub(sendBegin)).Seconds()) * 1000)
 
 		if timeElapsed > 1500 {
-			logger.Term("Frames: "+strconv.Itoa(frames)+"/"+strconv.Itoa(int(totalFramesSent))+"  Time: "+
+			logger.Term("Frames: "+strconv.Itoa(frames)+"/"+strconv.Itoa(int(s.totalFramesSent))+"  Time: "+
 				strconv.Itoa(int(timeElapsed/1000))+"/"+strconv.Itoa(int(timeSent/1000))+"s  Buffer: "+
 				strconv.Itoa(int(bufferSent))+"ms  Frames/Bytes: "+strconv.Itoa(framesToRead)+"/"+strconv.Itoa(len(lbuf)),
 				logger.LOG_INFO)
@@ -378,23 +539,20 @@ func StreamFFMPEG(filename string) error {
 
 		// regulate sending rate
 		timePause := 0
-		if bufferSent < (config.Cfg.BufferSize - 100) {
+		if bufferSent < (s.cfg.BufferSize - 100) {
 			timePause = 900 - sendLag
 		} else {
-			if bufferSent > config.Cfg.BufferSize {
+			if bufferSent > s.cfg.BufferSize {
 				timePause = 1100 - sendLag
 			} else {
 				timePause = 975 - sendLag
 			}
 		}
 
-		if Abort {
-			err := errors.New("Aborted by user")
-			cleanUp(err)
+		if !sleep(ctx, time.Duration(time.Millisecond)*time.Duration(timePause)) {
+			cleanUp(ctx.Err())
 			break
 		}
-
-		time.Sleep(time.Duration(time.Millisecond) * time.Duration(timePause))
 	}
 	cmd.Wait()
 	logger.Log("ffmpeg is dead. hoy!", logger.LOG_DEBUG)
@@ -402,3 +560,8 @@ func StreamFFMPEG(filename string) error {
 	//logger.Log(strconv.Itoa(cmd.ProcessState), logger.LOG_DEBUG)
 	return res
 }
+
+// formats the position as seconds for ffmpeg -ss and -to
+func ffmpegTime(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
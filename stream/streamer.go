@@ -0,0 +1,411 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/stunndard/goicy/config"
+	"github.com/stunndard/goicy/cuesheet"
+	"github.com/stunndard/goicy/logger"
+	"github.com/stunndard/goicy/metadata"
+	"github.com/stunndard/goicy/network"
+	"github.com/stunndard/goicy/playlist"
+	"github.com/stunndard/goicy/script"
+	"github.com/stunndard/goicy/util"
+)
+
+// Options configures a Streamer
+type Options struct {
+	// stream, server and playlist settings, as loaded by config.LoadConfig
+	Config config.Config
+
+	// NextTrack returns the next track to stream, first is true on the
+	// very first call. If nil, the playlist of the config is played.
+	NextTrack func(first bool) playlist.Entry
+
+	// event callbacks, all of them are optional
+	OnTrackStart func(filename string)
+	OnTrackEnd   func(filename string, err error)
+	OnMetadata   func(metadata string)
+	OnError      func(err error)
+}
+
+// Streamer streams tracks to all configured servers.
+// Any number of streamers can run in one process.
+type Streamer struct {
+	opts    Options
+	cfg     *config.Config
+	sources []*network.Source
+
+	totalFramesSent uint64
+	totalTimeBegin  time.Time
+
+	// metadata template fields of the current track
+	mu     sync.Mutex
+	fields metadata.Tags
+
+	// the playlist of the config, it's played unless the tracks
+	// come from NextTrack or the Lua script
+	pl *playlist.Playlist
+
+	// Lua playlist script
+	script *script.Script
+
+	// the playing track saved to npfile, it's resumed from
+	// the saved offset after restart
+	resume  time.Duration
+	npEntry playlist.Entry
+	npSaved time.Time
+
+	// the scheduled playlist starts at this time, the playing
+	// track is cut then, cut is set once it's cut
+	cutAt time.Time
+	cut   bool
+}
+
+// how often the playing position is saved to npfile
+const npSaveInterval = 10 * time.Second
+
+// NewStreamer creates a streamer with a source for every configured server
+func NewStreamer(opts Options) *Streamer {
+	s := &Streamer{opts: opts}
+	s.cfg = &s.opts.Config
+	s.pl = playlist.New(s.cfg)
+	for _, srv := range s.cfg.Servers {
+		s.sources = append(s.sources, network.NewSource(srv, s.cfg))
+	}
+	return s
+}
+
+// Sources returns the server connections of the streamer
+func (s *Streamer) Sources() []*network.Source {
+	return s.sources
+}
+
+// Playlist returns the playlist of the streamer, like to queue requests
+func (s *Streamer) Playlist() *playlist.Playlist {
+	return s.pl
+}
+
+// Run streams tracks until ctx is cancelled or the connection
+// attempts are exhausted
+func (s *Streamer) Run(ctx context.Context) error {
+	defer closeAll(s.sources)
+
+	if s.cfg.MetadataInput != "" {
+		interval := time.Duration(s.cfg.MetadataInterval) * time.Second
+		in, err := metadata.NewInput(s.cfg.MetadataInput, interval, s.sendMetadata)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := in.Run(ctx); err != nil && ctx.Err() == nil {
+				logger.Log("Metadata input failed: "+err.Error(), logger.LOG_ERROR)
+			}
+		}()
+	}
+
+	if s.cfg.PlaylistType == "lua" && s.opts.NextTrack == nil {
+		sc, err := script.Load(s.scriptFile())
+		if err != nil {
+			logger.Log("Cannot load script: "+err.Error(), logger.LOG_ERROR)
+			return err
+		}
+		defer sc.Close()
+		if !sc.Has("next_track") {
+			return errors.New("Script has no next_track() function")
+		}
+		s.script = sc
+	}
+
+	if s.opts.NextTrack == nil && s.script == nil {
+		if err := s.pl.Load(); err != nil {
+			logger.Log("Cannot load playlist file", logger.LOG_ERROR)
+			logger.Log(err.Error(), logger.LOG_ERROR)
+			return err
+		}
+	}
+
+	// requests are queued in front of the internal playlist
+	if s.cfg.RequestInput != "" && s.opts.NextTrack == nil && s.script == nil {
+		go func() {
+			if err := s.pl.ServeRequests(ctx, s.cfg.RequestInput); err != nil && ctx.Err() == nil {
+				logger.Log("Request input failed: "+err.Error(), logger.LOG_ERROR)
+			}
+		}()
+	}
+
+	retries := 0
+	entry := s.nextTrack(true)
+	for {
+		if s.opts.OnTrackStart != nil {
+			s.opts.OnTrackStart(entry.File)
+		}
+		if s.script != nil {
+			if err := s.script.OnTrackStart(trackInfo(entry)); err != nil {
+				logger.Log("Script on_track_start() failed: "+err.Error(), logger.LOG_ERROR)
+			}
+		}
+		// the resumed track starts from the saved position
+		var offset time.Duration
+		s.npEntry = entry
+		if s.resume > 0 {
+			if s.canSeek() && (entry.End == 0 || entry.Start+s.resume < entry.End) {
+				offset = s.resume
+			}
+			s.resume = 0
+		}
+
+		s.cutAt, s.cut = time.Time{}, false
+		if s.cfg.ScheduleCutIn && s.opts.NextTrack == nil && s.script == nil {
+			s.cutAt = s.pl.NextChange(time.Now())
+		}
+
+		var err error
+		if s.cfg.StreamType == "file" {
+			err = s.streamFile(ctx, entry, offset)
+		} else {
+			err = s.streamFFMPEG(ctx, entry, offset)
+		}
+		if s.opts.OnTrackEnd != nil {
+			s.opts.OnTrackEnd(entry.File, err)
+		}
+
+		// if aborted return immediately
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			retries++
+			logger.Log("Error streaming: "+err.Error(), logger.LOG_ERROR)
+			if s.opts.OnError != nil {
+				s.opts.OnError(err)
+			}
+
+			if retries == s.cfg.ConnAttempts {
+				logger.Log("No more retries", logger.LOG_INFO)
+				return err
+			}
+			// if that was a file error
+			switch err.(type) {
+			case *util.FileError:
+				entry = s.nextTrack(false)
+			default:
+
+			}
+
+			logger.Log("Retrying in 10 sec...", logger.LOG_INFO)
+			if !sleep(ctx, 10*time.Second) {
+				return ctx.Err()
+			}
+			continue
+		}
+		retries = 0
+		entry = s.nextTrack(false)
+	}
+}
+
+func (s *Streamer) nextTrack(first bool) playlist.Entry {
+	if s.opts.NextTrack != nil {
+		return s.opts.NextTrack(first)
+	}
+	if s.script != nil {
+		entry, err := s.script.NextTrack()
+		if err != nil {
+			logger.Log("Script next_track() failed: "+err.Error(), logger.LOG_ERROR)
+		}
+		return entry
+	}
+	if first {
+		if s.cfg.NpFile != "" {
+			if entry, offset, ok := s.pl.Resume(s.cfg.NpFile); ok {
+				if s.cfg.ResumePosition {
+					s.resume = offset
+				}
+				return entry
+			}
+		}
+		return s.pl.First()
+	}
+	// the track is cut ahead of time by what was sent ahead, the
+	// scheduled playlist has to start anyway
+	if s.cut && time.Now().Before(s.cutAt) {
+		return s.pl.NextAt(s.cutAt)
+	}
+	return s.pl.Next()
+}
+
+// whether the track has to be cut for the scheduled playlist, ahead
+// is how much of the track is sent ahead of time
+func (s *Streamer) cutIn(ahead time.Duration) bool {
+	if s.cutAt.IsZero() || time.Now().Add(ahead).Before(s.cutAt) {
+		return false
+	}
+	logger.Log("Cutting the track for the scheduled playlist", logger.LOG_INFO)
+	s.cut = true
+	return true
+}
+
+// whether the tracks can be started from any position
+func (s *Streamer) canSeek() bool {
+	switch s.cfg.StreamFormat {
+	case "ogg", "vorbis", "opus":
+		return s.cfg.StreamType != "file"
+	}
+	return true
+}
+
+// saves the playing track and the position in it to npfile, at most
+// every npSaveInterval unless forced. Only the internal playlist
+// tracks are saved, others can't be resumed.
+func (s *Streamer) saveNowPlaying(pos time.Duration, force bool) {
+	if s.cfg.NpFile == "" || s.opts.NextTrack != nil || s.script != nil {
+		return
+	}
+	if !force && time.Since(s.npSaved) < npSaveInterval {
+		return
+	}
+	s.npSaved = time.Now()
+	np := playlist.NowPlaying{Entry: s.npEntry, Index: s.pl.Index(), Offset: pos}
+	if err := playlist.SaveNowPlaying(s.cfg.NpFile, np); err != nil {
+		logger.Log("Cannot save npfile: "+err.Error(), logger.LOG_ERROR)
+	}
+}
+
+// whether the metadata comes from tags and cuesheets,
+// not from the external input
+func (s *Streamer) tagMetadata() bool {
+	return s.cfg.UpdateMetadata && s.cfg.MetadataInput == ""
+}
+
+// sets the playlist entry fields of the new track
+func (s *Streamer) startTrack(entry playlist.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	filename := entry.File
+	s.fields = metadata.Tags{
+		"file":     filename,
+		"filename": filepath.Base(filename),
+		"name":     util.Basename(filepath.Base(filename)),
+		"stream":   s.cfg.StreamName,
+	}
+	for k, v := range entry.Fallback {
+		s.fields[k] = v
+	}
+	for k, v := range entry.Fields {
+		s.fields[k] = v
+	}
+}
+
+// adds the fields to the current track
+func (s *Streamer) setFields(fields metadata.Tags) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range fields {
+		s.fields[k] = v
+	}
+}
+
+// returns the current track fields overridden by extra
+func (s *Streamer) fieldsWith(extra metadata.Tags) metadata.Tags {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := make(metadata.Tags, len(s.fields)+len(extra))
+	for k, v := range s.fields {
+		fields[k] = v
+	}
+	for k, v := range extra {
+		fields[k] = v
+	}
+	return fields
+}
+
+// the Lua playlist script, the playlist itself if script is not set
+func (s *Streamer) scriptFile() string {
+	if s.cfg.ScriptFile != "" {
+		return s.cfg.ScriptFile
+	}
+	return s.cfg.Playlist
+}
+
+// returns the on_track_start() info of the playlist entry
+func trackInfo(entry playlist.Entry) map[string]string {
+	info := map[string]string{
+		"file":     entry.File,
+		"filename": filepath.Base(entry.File),
+		"name":     util.Basename(filepath.Base(entry.File)),
+	}
+	for k, v := range entry.Fields {
+		info[k] = v
+	}
+	return info
+}
+
+// formats the song title by the script format_metadata(),
+// or by the metadataformat template
+func (s *Streamer) formatMetadata(fields metadata.Tags) string {
+	if s.script != nil {
+		md, ok, err := s.script.FormatMetadata(fields)
+		if err != nil {
+			logger.Log("Script format_metadata() failed: "+err.Error(), logger.LOG_ERROR)
+		}
+		if ok {
+			return md
+		}
+	}
+	return metadata.Format(s.cfg.MetadataFormat, fields, s.cfg.StreamName)
+}
+
+// sets the song title on all servers
+func (s *Streamer) sendMetadata(md string) {
+	if s.opts.OnMetadata != nil {
+		s.opts.OnMetadata(md)
+	}
+	metadata.SendMetadata(s.sources, md)
+}
+
+// reads the file tags and sends them as metadata, the fields
+// of the playlist entry take precedence over the tags and
+// the fallback ones are used for missing tags
+func (s *Streamer) sendTags(entry playlist.Entry) {
+	tags, err := metadata.GetTags(s.cfg.FFMPEGPath, entry.File)
+	if err != nil {
+		logger.Log("Cannot read tags: "+err.Error(), logger.LOG_DEBUG)
+		if len(entry.Fields) == 0 && len(entry.Fallback) == 0 {
+			return
+		}
+	}
+	s.setFields(tags)
+	s.setFields(entry.Fields)
+	s.sendMetadata(s.formatMetadata(s.fieldsWith(nil)))
+}
+
+// sends the metadata of the cuesheet track
+func (s *Streamer) sendCueMetadata(cue *cuesheet.CueSheet, t *cuesheet.Track) {
+	s.sendMetadata(s.formatMetadata(s.fieldsWith(cueFields(cue, t))))
+}
+
+// returns the fields of the cuesheet track, the empty ones are not set
+// so the tags of the file are used for them
+func cueFields(cue *cuesheet.CueSheet, t *cuesheet.Track) metadata.Tags {
+	return metadata.Tags(cue.Fields(t))
+}
+
+// sleeps for d, returns false if ctx was cancelled meanwhile
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+)
+
+// Serve accepts connections on the tcp or unix socket addr until ctx is
+// cancelled and calls handle for each of them. The connections are
+// closed once handle returns or ctx is cancelled, Serve returns after
+// all handlers have returned.
+func Serve(ctx context.Context, kind, addr string, handle func(conn net.Conn)) error {
+	if kind == "unix" {
+		// remove the socket left by a previous run
+		os.Remove(addr)
+	}
+	l, err := net.Listen(kind, addr)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+				case <-done:
+				}
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}